@@ -0,0 +1,14 @@
+package config
+
+// eviction policies applied when a new message exceeds the cache quota of its topic
+const (
+	CacheEvictOldest  = "drop_oldest"   // evict the oldest messages of the topic to make room
+	CacheRejectNewest = "reject_newest" // reject the new message, the publisher is told with an error
+)
+
+type CacheConfig struct {
+	MaxMessages    int    `yaml:"max_messages"`    // per topic, 0 means unlimited
+	MaxBytes       int    `yaml:"max_bytes"`       // per topic, 0 means unlimited
+	EvictionPolicy string `yaml:"eviction_policy"` // drop_oldest or reject_newest
+	MemoryBudget   int64  `yaml:"memory_budget"`   // in bytes, no more messages are cached once it's used up, 0 means unlimited
+}
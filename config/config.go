@@ -8,10 +8,12 @@ import (
 )
 
 type Config struct {
-	RelayServerConfig  RelayConfig  `yaml:"relay_config"`
-	WsServerConfig     WsConfig     `yaml:"wsserver_config"`
-	RedisServerConfig  RedisConfig  `yaml:"redis_config"`
-	MetricServerConfig MetricConfig `yaml:"metric_config"`
+	RelayServerConfig  RelayConfig   `yaml:"relay_config"`
+	WsServerConfig     WsConfig      `yaml:"wsserver_config"`
+	RedisServerConfig  RedisConfig   `yaml:"redis_config"`
+	CacheConfig        CacheConfig   `yaml:"cache_config"`
+	WebhookConfig      WebhookConfig `yaml:"webhook_config"`
+	MetricServerConfig MetricConfig  `yaml:"metric_config"`
 }
 
 type MetricConfig struct {
@@ -21,8 +23,10 @@ type MetricConfig struct {
 
 var defaultConfig = Config{
 	RelayServerConfig: RelayConfig{
-		Version:                     "1.0",
-		Mode:                        "legacy",
+		Version:                     VersionAuto,
+		Mode:                        ModeLegacy,
+		Backend:                     BackendRedis,
+		Delivery:                    DeliveryPubSub,
 		Listen:                      ":8080",
 		GracefulShutdownWaitSeconds: 5,
 	},
@@ -31,10 +35,44 @@ var defaultConfig = Config{
 		CheckSessionExpireInterval: 10,
 		PendingSessionCacheTime:    1800, // in seconds
 		MessageCacheTime:           1800,
+		MinMessageTTL:              10,
+		MaxMessageTTL:              24 * 3600,
 		AllowedOrigins:             []string{"*"},
+		AllowEmptyOrigin:           true,
+		BrokerCheckInterval:        5,
+		SendBufferSize:             8,
+		SlowConsumerPolicy:         SlowConsumerCache,
+		MessageRate:                20,
+		MessageBurst:               50,
+		IPMessageRate:              0, // opt-in, behind proxies the clients share the proxy ip unless it is trusted
+		IPMessageBurst:             500,
+		ConnectionRate:             0,
+		ConnectionBurst:            20,
+		RateLimitViolations:        20,
+		MaxFrameSize:               1 << 20,
+		MaxPayloadSize:             512 << 10,
+		MaxTopicLength:             128,
+		TopicFormat:                TopicFormatAny,
+		SubscriberTTL:              60,
 	},
 	RedisServerConfig: RedisConfig{
-		ServerAddr: "127.0.0.1:6379",
+		Mode:          RedisModeStandalone,
+		ServerAddr:    "127.0.0.1:6379",
+		ShardedPubSub: true,
+	},
+	CacheConfig: CacheConfig{
+		MaxMessages:    100,
+		MaxBytes:       1 << 20,
+		EvictionPolicy: CacheEvictOldest,
+	},
+	WebhookConfig: WebhookConfig{
+		Enable:          false,
+		RegistrationTTL: 30 * 24 * 3600,
+		Timeout:         5,
+		MaxRetries:      3,
+		RetryInterval:   1,
+		Workers:         8,
+		QueueSize:       1024,
 	},
 	MetricServerConfig: MetricConfig{
 		Enable: true,
@@ -1,6 +1,46 @@
 package config
 
+// redis deployment modes
+const (
+	RedisModeStandalone = "standalone"
+	RedisModeSentinel   = "sentinel"
+	RedisModeCluster    = "cluster"
+)
+
 type RedisConfig struct {
-	ServerAddr string `yaml:"server_addr"`
+	Mode string `yaml:"mode"` // standalone, sentinel or cluster
+
+	ServerAddr string `yaml:"server_addr"` // standalone only
+	Username   string `yaml:"username"`    // ACL username, redis 6+
 	Password   string `yaml:"password"`
+	DB         int    `yaml:"db"` // not supported in cluster mode
+
+	// sentinel only
+	MasterName       string   `yaml:"master_name"`
+	SentinelAddrs    []string `yaml:"sentinel_addrs,omitempty"`
+	SentinelUsername string   `yaml:"sentinel_username"`
+	SentinelPassword string   `yaml:"sentinel_password"`
+
+	// cluster only
+	ClusterAddrs  []string `yaml:"cluster_addrs,omitempty"` // seed nodes
+	ShardedPubSub bool     `yaml:"sharded_pubsub"`          // use SSUBSCRIBE/SPUBLISH, redis 7+
+
+	TLS RedisTLSConfig `yaml:"tls"`
+
+	// connection pool and timeouts, zero means the go-redis default
+	PoolSize     int `yaml:"pool_size"`
+	MinIdleConns int `yaml:"min_idle_conns"`
+	DialTimeout  int `yaml:"dial_timeout"`  // in seconds
+	ReadTimeout  int `yaml:"read_timeout"`  // in seconds
+	WriteTimeout int `yaml:"write_timeout"` // in seconds
+	PoolTimeout  int `yaml:"pool_timeout"`  // in seconds
+}
+
+type RedisTLSConfig struct {
+	Enable             bool   `yaml:"enable"`
+	CAFile             string `yaml:"ca_file"`   // verify the server with the CA instead of the system ones
+	CertFile           string `yaml:"cert_file"` // client certificate, for mutual TLS
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
 }
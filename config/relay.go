@@ -1,8 +1,35 @@
 package config
 
+// protocol versions
+const (
+	Version1    = "1.0"  // WalletConnect v1 only
+	Version2    = "2.0"  // WalletConnect v2 only
+	VersionAuto = "auto" // detected per connection
+)
+
+// modes of the v1 protocol
+const (
+	ModeLegacy = "legacy" // v1 with the Rabby extensions
+	ModeStrict = "strict" // v1 strictly following the spec
+)
+
+// message backends
+const (
+	BackendRedis  = "redis"  // redis pub/sub and cache, for multiple relay nodes
+	BackendMemory = "memory" // in process, for a single relay node without redis
+)
+
+// message delivery modes
+const (
+	DeliveryPubSub = "pubsub" // fire-and-forget, the messages are only cached when no relay node subscribes the topic
+	DeliveryStream = "stream" // at-least-once, the messages are kept in redis streams until the subscribers receive them
+)
+
 type RelayConfig struct {
-	Version string `yaml:"version"`
-	Mode    string `yaml:"mode"`
+	Version  string `yaml:"version"`
+	Mode     string `yaml:"mode"`
+	Backend  string `yaml:"backend"`
+	Delivery string `yaml:"delivery"`
 
 	Listen                      string `yaml:"listen"`
 	GracefulShutdownWaitSeconds int    `yaml:"graceful_shutdown_wait_seconds"`
@@ -0,0 +1,12 @@
+package config
+
+type WebhookConfig struct {
+	Enable          bool     `yaml:"enable"`
+	RegistrationTTL int      `yaml:"registration_ttl"`        // in seconds
+	AllowedHosts    []string `yaml:"allowed_hosts,omitempty"` // the hosts the webhooks may point to, required once enabled
+	Timeout         int      `yaml:"timeout"`                 // in seconds
+	MaxRetries      int      `yaml:"max_retries"`             //
+	RetryInterval   int      `yaml:"retry_interval"`          // in seconds, doubled on every retry
+	Workers         int      `yaml:"workers"`                 // number of concurrent webhook calls
+	QueueSize       int      `yaml:"queue_size"`              // the webhook calls are dropped once the queue is full
+}
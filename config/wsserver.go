@@ -1,9 +1,46 @@
 package config
 
+// policies applied when a client doesn't keep up with its messages, i.e. its send buffer is full
+const (
+	SlowConsumerDrop       = "drop"       // drop the message
+	SlowConsumerCache      = "cache"      // cache the message, it's received on next subscription
+	SlowConsumerDisconnect = "disconnect" // disconnect the client, the messages are cached when flushing the connection
+)
+
+// formats of the topics
+const (
+	TopicFormatAny           = "any"           // any non-empty topic
+	TopicFormatUUID          = "uuid"          // uuid v4, used by WalletConnect v1
+	TopicFormatHex           = "hex"           // 32-byte hex, used by WalletConnect v2
+	TopicFormatWalletConnect = "walletconnect" // either uuid v4 or 32-byte hex
+)
+
 type WsConfig struct {
 	HeartbeatInterval          int      `yaml:"heartbeat_interval"`            // in seconds
 	CheckSessionExpireInterval int      `yaml:"check_session_expire_interval"` // in seconds
 	PendingSessionCacheTime    int      `yaml:"pending_session_cache_time"`    // in seconds
-	MessageCacheTime           int      `yaml:"message_cache_time"`            //
-	AllowedOrigins             []string `yaml:"allowed_origins"`
+	MessageCacheTime           int      `yaml:"message_cache_time"`            // in seconds, unless the message has its own ttl
+	MinMessageTTL              int      `yaml:"min_message_ttl"`               // in seconds, the ttl of the messages is clamped to [min, max]
+	MaxMessageTTL              int      `yaml:"max_message_ttl"`               // in seconds
+	ReplayCachedMessages       bool     `yaml:"replay_cached_messages"`        // keep the cached messages after they're received, until they expire
+	AllowedOrigins             []string `yaml:"allowed_origins"`               // e.g. "*", "debank.com", "*.debank.com", "https://debank.com"
+	AllowEmptyOrigin           bool     `yaml:"allow_empty_origin"`            // native mobile wallets don't send the Origin header
+	BrokerCheckInterval        int      `yaml:"broker_check_interval"`         // in seconds, the channels are resubscribed once the broker recovers
+	SendBufferSize             int      `yaml:"send_buffer_size"`              // number of messages buffered for each connection
+	SlowConsumerPolicy         string   `yaml:"slow_consumer_policy"`          // drop, cache or disconnect
+	EventLoops                 int      `yaml:"event_loops"`                   // number of loops handling the messages, 0 means the number of CPUs
+	MessageRate                float64  `yaml:"message_rate"`                  // messages per second of each connection, 0 means unlimited
+	MessageBurst               int      `yaml:"message_burst"`                 //
+	IPMessageRate              float64  `yaml:"ip_message_rate"`               // messages per second of all connections from one ip, 0 means unlimited
+	IPMessageBurst             int      `yaml:"ip_message_burst"`              //
+	ConnectionRate             float64  `yaml:"connection_rate"`               // new connections per second from one ip, 0 means unlimited
+	ConnectionBurst            int      `yaml:"connection_burst"`              //
+	RateLimitViolations        int      `yaml:"rate_limit_violations"`         // the connection is closed after that many limited messages, 0 means never
+	TrustedProxies             []string `yaml:"trusted_proxies,omitempty"`     // ips or cidrs of the proxies whose X-Forwarded-For is honored
+	MaxFrameSize               int64    `yaml:"max_frame_size"`                // in bytes, the connection is closed if a frame exceeds it, 0 means unlimited
+	MaxPayloadSize             int      `yaml:"max_payload_size"`              // in bytes, 0 means unlimited
+	MaxTopicLength             int      `yaml:"max_topic_length"`              // 0 means unlimited
+	TopicFormat                string   `yaml:"topic_format"`                  // any, uuid, hex or walletconnect
+	MaxSubscribersPerTopic     int      `yaml:"max_subscribers_per_topic"`     // simultaneous subscribers of a topic across the relay nodes, 0 means unlimited
+	SubscriberTTL              int      `yaml:"subscriber_ttl"`                // in seconds, a subscriber of a crashed relay node is counted until then
 }
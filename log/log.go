@@ -48,6 +48,16 @@ func ProductionModeWithoutStackTrace() {
 
 	buildLoggerWithConfig(config)
 }
+
+// ReplaceLogger replaces the logger, e.g. with `zap.NewNop()` in the benchmarks, returns a function to restore it
+func ReplaceLogger(l *zap.Logger) func() {
+	prev := logger
+	logger = l.WithOptions(zap.AddCallerSkip(1))
+	return func() {
+		logger = prev
+	}
+}
+
 func buildLoggerWithConfig(config zap.Config) {
 	zapLogger, err := config.Build(zap.AddCallerSkip(1))
 	if err != nil {
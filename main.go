@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"net/http"
@@ -54,6 +55,7 @@ func parseCmdlineAndLoadConfig() config.Config {
 	// define cmdline options
 	flag.StringVar(&cmdlineConfig.RelayServerConfig.Listen, "relay.addr", "", "relay server listen address")
 	flag.StringVar(&cmdlineConfig.RedisServerConfig.ServerAddr, "redis.server_addr", "", "redis server address")
+	flag.StringVar(&cmdlineConfig.RelayServerConfig.Backend, "backend", "", "message backend, redis or memory")
 
 	flag.Parse()
 
@@ -69,6 +71,10 @@ func parseCmdlineAndLoadConfig() config.Config {
 		fileConfig.RedisServerConfig.ServerAddr = serverAddr
 	}
 
+	if backend := cmdlineConfig.RelayServerConfig.Backend; backend != "" {
+		fileConfig.RelayServerConfig.Backend = backend
+	}
+
 	return fileConfig
 }
 
@@ -100,7 +106,8 @@ func main() {
 	waitSeconds := config.RelayServerConfig.GracefulShutdownWaitSeconds
 	log.Printf("Sig %v received, shutting down, graceful shutdown wait: %v seconds\n", sig, waitSeconds)
 
-	<-time.After(time.Duration(waitSeconds) * time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(waitSeconds)*time.Second)
+	defer cancel()
 
-	relayServer.Shutdown()
+	relayServer.Shutdown(ctx)
 }
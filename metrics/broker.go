@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	gaugeBrokerUp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "broker_up",
+		Help:      "Whether the broker is reachable, 1 for up and 0 for down",
+	})
+
+	countBrokerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "broker_errors",
+		Help:      "Number of failed broker operations",
+	}, []string{"op"})
+
+	countBrokerResubscriptions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "broker_resubscriptions",
+		Help:      "Number of times the channels are resubscribed after the broker recovers",
+	})
+)
+
+func SetBrokerUp(up bool) {
+	if up {
+		gaugeBrokerUp.Set(1)
+	} else {
+		gaugeBrokerUp.Set(0)
+	}
+}
+
+func IncBrokerError(op string) {
+	countBrokerErrors.With(prometheus.Labels{"op": op}).Inc()
+}
+
+func IncBrokerResubscription() {
+	countBrokerResubscriptions.Inc()
+}
+
+func init() {
+	prometheus.MustRegister(gaugeBrokerUp)
+	prometheus.MustRegister(countBrokerErrors)
+	prometheus.MustRegister(countBrokerResubscriptions)
+}
@@ -24,12 +24,40 @@ var (
 		Help:      "Number of current connections",
 	})
 
+	countRejectedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "rejected_connections",
+		Help:      "Number of rejected websocket upgrades",
+	}, []string{"reason"})
+
+	countHeartbeatTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "heartbeat_timeouts",
+		Help:      "Number of connections closed for not responding to websocket pings",
+	})
+
 	countSendBlocking = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: promNamespace,
 		Subsystem: promSubsystem,
 		Name:      "send_blockings",
 		Help:      "Number of send blocking connections",
 	})
+
+	countSlowConsumerMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "slow_consumer_messages",
+		Help:      "Number of messages overflowing the send buffer, by the action taken",
+	}, []string{"action"})
+
+	countRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "rate_limited",
+		Help:      "Number of messages and connections exceeding the rate limits, by the limit hit",
+	}, []string{"limit"})
 )
 
 func IncNewConnection() {
@@ -40,10 +68,26 @@ func IncClosedConnection() {
 	countClosedConnections.Inc()
 }
 
+func IncRejectedConnection(reason string) {
+	countRejectedConnections.With(prometheus.Labels{"reason": reason}).Inc()
+}
+
+func IncHeartbeatTimeout() {
+	countHeartbeatTimeouts.Inc()
+}
+
 func IncSendBlocking() {
 	countSendBlocking.Inc()
 }
 
+func IncSlowConsumerMessage(action string) {
+	countSlowConsumerMessages.With(prometheus.Labels{"action": action}).Inc()
+}
+
+func IncRateLimited(limit string) {
+	countRateLimited.With(prometheus.Labels{"limit": limit}).Inc()
+}
+
 func SetCurrentConnections(num int) {
 	gaugeCurrentConnections.Set(float64(num))
 }
@@ -52,5 +96,9 @@ func init() {
 	prometheus.MustRegister(countNewConnections)
 	prometheus.MustRegister(countClosedConnections)
 	prometheus.MustRegister(gaugeCurrentConnections)
+	prometheus.MustRegister(countRejectedConnections)
+	prometheus.MustRegister(countHeartbeatTimeouts)
 	prometheus.MustRegister(countSendBlocking)
+	prometheus.MustRegister(countRateLimited)
+	prometheus.MustRegister(countSlowConsumerMessages)
 }
@@ -26,6 +26,40 @@ var (
 		Help:      "Number of cached messages consumed",
 	})
 
+	countCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "cache_evictions",
+		Help:      "Number of cached messages evicted to make room for the new ones",
+	})
+	countCacheRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "cache_rejections",
+		Help:      "Number of messages rejected by the cache",
+	}, []string{"reason"})
+
+	countWebhookCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "webhook_calls",
+		Help:      "Number of push notification webhook calls",
+	}, []string{"result"})
+
+	countOversizeMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "oversize_messages",
+		Help:      "Number of messages rejected for exceeding the size limits, by the limit exceeded",
+	}, []string{"limit"})
+
+	countRejectedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "rejected_messages",
+		Help:      "Number of messages rejected for their topics, by the reason",
+	}, []string{"reason"})
+
 	countMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: promNamespace,
 		Subsystem: promSubsystem,
@@ -79,6 +113,26 @@ func DecCachedMessages() {
 	countMessages.With(prometheus.Labels{"phase": "delay_delivered"}).Inc()
 }
 
+func AddCacheEvictions(num int) {
+	countCacheEvictions.Add(float64(num))
+}
+
+func IncCacheRejection(reason string) {
+	countCacheRejections.With(prometheus.Labels{"reason": reason}).Inc()
+}
+
+func IncWebhookCall(result string) {
+	countWebhookCalls.With(prometheus.Labels{"result": result}).Inc()
+}
+
+func IncOversizeMessage(limit string) {
+	countOversizeMessages.With(prometheus.Labels{"limit": limit}).Inc()
+}
+
+func IncRejectedMessage(reason string) {
+	countRejectedMessages.With(prometheus.Labels{"reason": reason}).Inc()
+}
+
 func IncNewRequestedSessions() {
 	countNewRequestedSessions.Inc()
 	countSessions.With(prometheus.Labels{"phase": "new"}).Inc()
@@ -103,6 +157,11 @@ func init() {
 	prometheus.MustRegister(countTotalMessages)
 	prometheus.MustRegister(countCachedMessages)
 	prometheus.MustRegister(countUncachedMessages)
+	prometheus.MustRegister(countCacheEvictions)
+	prometheus.MustRegister(countCacheRejections)
+	prometheus.MustRegister(countWebhookCalls)
+	prometheus.MustRegister(countOversizeMessages)
+	prometheus.MustRegister(countRejectedMessages)
 
 	prometheus.MustRegister(countMessages)
 	prometheus.MustRegister(countSessions)
@@ -0,0 +1,85 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// BrokerMessage is a message received from a subscribed broker channel
+type BrokerMessage struct {
+	Channel string
+	Payload string
+}
+
+// Broker relays messages among the relay nodes
+type Broker interface {
+	// Publish publishes the message to the channel, returns the number of relay nodes receiving it
+	Publish(ctx context.Context, channel string, message SocketMessage) (int64, error)
+	Subscribe(ctx context.Context, channels ...string) error
+	// Unsubscribe unsubscribes the channels, or all of the subscribed channels if none is given
+	Unsubscribe(ctx context.Context, channels ...string) error
+	// Presence returns the number of relay nodes subscribing the channel
+	Presence(ctx context.Context, channel string) (int64, error)
+	// Messages returns the messages received from the subscribed channels
+	Messages() <-chan *BrokerMessage
+	// Ping checks the connectivity to the broker
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+var (
+	// the message exceeds the cache quota of the topic, and the quota policy is to reject it
+	errCacheQuotaExceeded = errors.New("cache quota of the topic exceeded")
+	// the cache memory budget is used up
+	errCacheBudgetExceeded = errors.New("cache memory budget exceeded")
+)
+
+// MessageStore caches the messages of a topic until its subscribers come online
+type MessageStore interface {
+	// Append caches the message, the message expires after `ttl`, returns the number of the messages
+	// evicted to make room for it
+	Append(ctx context.Context, topic string, message SocketMessage, ttl time.Duration) (int, error)
+	// Drain returns and clears the cached messages of the topic atomically
+	Drain(ctx context.Context, topic string) ([]SocketMessage, error)
+	// Range returns the cached messages of the topic without clearing them
+	Range(ctx context.Context, topic string) ([]SocketMessage, error)
+	// Delete clears the cached messages of the topic
+	Delete(ctx context.Context, topic string) error
+	Close() error
+}
+
+// MessageStream keeps the messages of a topic until its subscribers receive them, so that the messages
+// are delivered at least once
+type MessageStream interface {
+	// Add appends the message to the stream of the topic
+	Add(ctx context.Context, topic string, message SocketMessage) error
+	// Read returns the messages of the topic not read yet, or the ones read but not acknowledged if `pending` is set
+	Read(ctx context.Context, topic string, pending bool) ([]SocketMessage, error)
+	// Ack acknowledges the messages have been received, they're dropped and won't be read again
+	Ack(ctx context.Context, topic string, ids ...string) error
+	// Delete drops the stream of the topic
+	Delete(ctx context.Context, topic string) error
+}
+
+// WebhookStore keeps the push notification webhooks registered by the wallets
+type WebhookStore interface {
+	// Register registers the webhook of the topic, it expires after `ttl` unless registered again,
+	// `errWebhookTaken` is returned if the topic has been registered with another token
+	Register(ctx context.Context, registration WebhookRegistration, ttl time.Duration) error
+	// Get returns the webhook of the topic, or nil if there's none
+	Get(ctx context.Context, topic string) (*WebhookRegistration, error)
+}
+
+// SubscriberStore counts the subscribers of the topics across the relay nodes, so that the subscribers of
+// a topic are limited no matter which relay node they connect to
+type SubscriberStore interface {
+	// Join adds the subscriber to the topic if it has joined already or the topic has less than `max` subscribers,
+	// the subscriber expires after `ttl` unless it joins or is refreshed again,
+	// returns whether it's admitted and whether it had joined before
+	Join(ctx context.Context, topic string, subscriber string, max int, ttl time.Duration) (admitted bool, joined bool, err error)
+	// Leave removes the subscribers from the topic
+	Leave(ctx context.Context, topic string, subscribers ...string) error
+	// Refresh keeps the subscribers of the topics, keyed by the topics, for another `ttl`
+	Refresh(ctx context.Context, subscribers map[string][]string, ttl time.Duration) error
+}
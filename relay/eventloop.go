@@ -0,0 +1,152 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/RabbyHub/derelay/log"
+	"go.uber.org/zap"
+)
+
+// number of events queued for each event loop
+const eventQueueSize = 1024
+
+// eventLoop handles the local and remote messages of the topics hashed to it, so the messages of one topic
+// are always handled in order, while the messages of different topics are handled in parallel
+type eventLoop struct {
+	local  chan SocketMessage  // messages of the local clients
+	remote chan *BrokerMessage // messages received from the broker channels
+	probes chan chan struct{}  // closed by the loop to prove it's alive
+}
+
+func newEventLoop() *eventLoop {
+	return &eventLoop{
+		local:  make(chan SocketMessage, eventQueueSize),
+		remote: make(chan *BrokerMessage, eventQueueSize),
+		probes: make(chan chan struct{}),
+	}
+}
+
+// loopOf returns the event loop handling the topic
+func (ws *WsServer) loopOf(topic string) *eventLoop {
+	if len(ws.loops) == 1 {
+		return ws.loops[0]
+	}
+	return ws.loops[hashString(topic)%uint32(len(ws.loops))]
+}
+
+// dispatch queues the local message to the event loop of its topic, a batch subscription is handled
+// by the loop of its first topic. the message is dropped once the server quits, as the loops are gone
+func (ws *WsServer) dispatch(message SocketMessage) {
+	topic := message.Topic
+	if topics := message.topics(); len(topics) > 0 {
+		topic = topics[0]
+	}
+
+	ws.dispatching.RLock()
+	defer ws.dispatching.RUnlock()
+	if ws.quitting {
+		log.Warn("relay is shutting down, drop message", zap.Any("client", message.client), zap.Any("message", message))
+		return
+	}
+	ws.loopOf(topic).local <- message
+}
+
+// runLoop handles the events of the loop until the server quits, the messages already queued
+// are still handled then
+func (ws *WsServer) runLoop(loop *eventLoop) {
+	defer ws.loopsDone.Done()
+	for {
+		select {
+		case message := <-loop.local:
+			ws.handleLocalMessage(message)
+
+		case chmessage := <-loop.remote:
+			ws.handleRemoteMessage(chmessage)
+
+		case probe := <-loop.probes:
+			close(probe)
+
+		case <-ws.quit:
+			for {
+				select {
+				case message := <-loop.local:
+					ws.handleLocalMessage(message)
+				case chmessage := <-loop.remote:
+					ws.handleRemoteMessage(chmessage)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// routeRemote routes the messages received from the broker to the event loops by their topics
+func (ws *WsServer) routeRemote(remoteCh <-chan *BrokerMessage) {
+	defer ws.loopsDone.Done()
+	for {
+		select {
+		case chmessage, ok := <-remoteCh:
+			// the broker has been closed
+			if !ok {
+				return
+			}
+			ws.loopOf(channelTopic(chmessage.Channel)).remote <- chmessage
+
+		case <-ws.quit:
+			// the loops are quitting as well, forward the rest right here
+			for {
+				select {
+				case chmessage, ok := <-remoteCh:
+					if !ok {
+						return
+					}
+					ws.handleRemoteMessage(chmessage)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// handleLocalMessage handles the message of a local client
+func (ws *WsServer) handleLocalMessage(message SocketMessage) {
+	// local message could be "pub", "sub" or "ack" or "ping", or the irn_* requests of v2 clients
+	handler, ok := ws.handler(message)
+	if !ok {
+		log.Debug("unsupported message", zap.Any("client", message.client), zap.Any("message", message))
+		ws.sendError(message.client, message.Topic, ErrorUnsupported, fmt.Sprintf("unsupported message type: %q", message.Type))
+		return
+	}
+	if message.Type != Ping {
+		log.Info("local message", zap.Any("client", message.client), zap.Any("message", message))
+	}
+
+	// the topic-client relationships must be updated in order
+	if !ws.updateTopics(message) {
+		return
+	}
+
+	// pub/sub message handler may contain time-consuming operations(e.g. read/write redis)
+	// so put them in separate goroutine to avoid blocking the event loop
+	ws.handling.Add(1)
+	go func() {
+		defer ws.handling.Done()
+		handler(ws, message)
+	}()
+}
+
+// probe checks whether the loop receiving from `probes` is alive
+func probe(ctx context.Context, probes chan chan struct{}) error {
+	done := make(chan struct{})
+	select {
+	case probes <- done:
+	case <-ctx.Done():
+		return errors.New("event loop is stuck")
+	}
+	<-done
+	return nil
+}
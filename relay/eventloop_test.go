@@ -0,0 +1,198 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/RabbyHub/derelay/config"
+	"github.com/RabbyHub/derelay/log"
+	"go.uber.org/zap"
+)
+
+func TestLoopOf(t *testing.T) {
+	conf := config.LoadConfig("")
+	conf.WsServerConfig.EventLoops = 4
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+
+	if len(ws.loops) != 4 {
+		t.Fatalf("length error, expected: %v, actual: %v", 4, len(ws.loops))
+	}
+	used := map[*eventLoop]bool{}
+	for i := 0; i < 100; i++ {
+		topic := fmt.Sprintf("topic-%v", i)
+		if ws.loopOf(topic) != ws.loopOf(topic) {
+			t.Errorf("topic should always be handled by the same loop: %v", topic)
+		}
+		used[ws.loopOf(topic)] = true
+	}
+	if len(used) != 4 {
+		t.Errorf("topics should be spread over the loops, expected: %v, actual: %v", 4, len(used))
+	}
+}
+
+func TestEventLoopsForwardRemoteMessages(t *testing.T) {
+	conf := config.LoadConfig("")
+	conf.WsServerConfig.EventLoops = 4
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+
+	subscribers := map[string]*client{}
+	for i := 0; i < 8; i++ {
+		topic := fmt.Sprintf("topic-%v", i)
+		subscribers[topic] = newTestClient(ws)
+		subscribers[topic].sendbuf = make(chan SocketMessage, 16)
+		ws.subscribers.Set(topic, subscribers[topic])
+	}
+
+	go ws.Run()
+	for i := 0; i < 10; i++ {
+		for topic := range subscribers {
+			payload, _ := json.Marshal(SocketMessage{Topic: topic, Type: Pub, Payload: fmt.Sprint(i)})
+			backend.messages <- &BrokerMessage{Channel: messageChanKey(topic), Payload: string(payload)}
+		}
+	}
+
+	for topic, subscriber := range subscribers {
+		// the messages of a topic are forwarded in order
+		for i := 0; i < 10; i++ {
+			select {
+			case message := <-subscriber.sendbuf:
+				if message.Topic != topic || message.Payload != fmt.Sprint(i) || !message.recache {
+					t.Errorf("message error, expected: %v %v, actual: %v %v", topic, i, message.Topic, message.Payload)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("message not forwarded, topic: %v", topic)
+			}
+		}
+	}
+	ws.Shutdown(context.Background())
+}
+
+func TestEventLoopDrainsLocalMessages(t *testing.T) {
+	conf := config.LoadConfig("")
+	conf.WsServerConfig.EventLoops = 1
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+
+	var handled atomic.Int32
+	ws.handlers[V1][Pub] = func(ws *WsServer, message SocketMessage) {
+		time.Sleep(10 * time.Millisecond)
+		handled.Add(1)
+	}
+	dapp := newTestClient(ws)
+	for i := 0; i < 3; i++ {
+		ws.dispatch(SocketMessage{Topic: "hello", Type: Pub, Payload: fmt.Sprint(i), client: dapp})
+	}
+
+	// the queued messages are still handled once the server quits
+	ws.quitting = true
+	close(ws.quit)
+	ws.loopsDone.Add(1)
+	ws.runLoop(ws.loops[0])
+	ws.handling.Wait()
+	if actual := handled.Load(); actual != 3 {
+		t.Errorf("handled messages error, expected: %v, actual: %v", 3, actual)
+	}
+
+	// while the later ones are dropped
+	ws.dispatch(SocketMessage{Topic: "hello", Type: Pub, Payload: "3", client: dapp})
+	if len(ws.loops[0].local) != 0 {
+		t.Errorf("message should be dropped after quitting")
+	}
+}
+
+// BenchmarkEventLoops forwards the remote messages of 256 topics to their subscribers
+// with different numbers of event loops
+func BenchmarkEventLoops(b *testing.B) {
+	defer log.ReplaceLogger(zap.NewNop())()
+
+	for _, loops := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("loops-%v", loops), func(b *testing.B) {
+			benchmarkEventLoops(b, loops, 256)
+		})
+	}
+}
+
+func benchmarkEventLoops(b *testing.B, loops int, topics int) {
+	conf := config.LoadConfig("")
+	conf.WsServerConfig.EventLoops = loops
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+
+	received := atomic.Int64{}
+	done := make(chan struct{})
+	defer close(done)
+	messages := make([]*BrokerMessage, topics)
+	for i := range messages {
+		topic := fmt.Sprintf("%032x", i)
+		subscriber := newTestClient(ws)
+		subscriber.sendbuf = make(chan SocketMessage, 1024)
+		ws.subscribers.Set(topic, subscriber)
+		go func() {
+			for {
+				select {
+				case <-subscriber.sendbuf:
+					received.Add(1)
+				case <-done:
+					return
+				}
+			}
+		}()
+
+		payload, _ := json.Marshal(SocketMessage{Topic: topic, Type: Pub, Payload: strings.Repeat("f", 512)})
+		messages[i] = &BrokerMessage{Channel: messageChanKey(topic), Payload: string(payload)}
+	}
+
+	go ws.Run()
+	defer ws.Shutdown(context.Background())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		backend.messages <- messages[i%topics]
+	}
+	for received.Load() < int64(b.N) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDisconnectedClientNotAddedToTopics(t *testing.T) {
+	conf := config.LoadConfig("")
+	conf.WsServerConfig.MaxSubscribersPerTopic = 1
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+	ws.setupSubscriberLimit(NewMemorySubscriberStore())
+
+	wallet := newTestClient(ws)
+	message := SocketMessage{Topic: "hello", Type: Sub, client: wallet}
+	if !wallet.admitSubscription(message) {
+		t.Fatalf("subscription should be admitted")
+	}
+	// the main loop unregisters the client before its queued subscription is handled
+	ws.handleClientDisconnect(wallet)
+	ws.handleLocalMessage(message)
+	ws.handling.Wait()
+
+	if ws.subscribers.Len("hello") != 0 || ws.wantsChannel(messageChanKey("hello")) {
+		t.Errorf("disconnected client should not subscribe, subscribers: %v", ws.subscribers.Len("hello"))
+	}
+	if len(backend.subscribed) != 0 {
+		t.Errorf("channels of the disconnected client should not be subscribed, actual: %v", backend.subscribed)
+	}
+
+	// the slot is released for the wallet reconnecting
+	reconnected := newTestClient(ws)
+	deadline := time.Now().Add(time.Second)
+	for !reconnected.admitSubscription(SocketMessage{Topic: "hello", Type: Sub, client: reconnected}) {
+		<-reconnected.sendbuf
+		if time.Now().After(deadline) {
+			t.Fatalf("subscription should be admitted after the disconnected client leaves")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,212 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// ProtocolVersion is the wire protocol spoken on a websocket connection
+type ProtocolVersion string
+
+const (
+	V1 ProtocolVersion = "1.0" // SocketMessage based `pub`/`sub`/`ack`
+	V2 ProtocolVersion = "2.0" // JSON-RPC 2.0 based `irn_*` methods
+)
+
+const JsonRpcVersion = "2.0"
+
+// WalletConnect v2 relay methods, the incoming ones are used as the `Type` of
+// the SocketMessage they are translated to
+const (
+	IrnPublish        MessageType = "irn_publish"
+	IrnSubscribe      MessageType = "irn_subscribe"
+	IrnUnsubscribe    MessageType = "irn_unsubscribe"
+	IrnBatchSubscribe MessageType = "irn_batchSubscribe"
+	IrnSubscription   MessageType = "irn_subscription"
+)
+
+// standard JSON-RPC 2.0 error codes
+const (
+	JsonRpcParseError     = -32700
+	JsonRpcInvalidRequest = -32600
+	JsonRpcMethodNotFound = -32601
+	JsonRpcInvalidParams  = -32602
+	JsonRpcServerError    = -32000
+	JsonRpcLimitExceeded  = -32005 // the rate limit is exceeded, as EIP-1474
+)
+
+type JsonRpcRequest struct {
+	ID      json.RawMessage `json:"id"`
+	JsonRpc string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type JsonRpcResponse struct {
+	ID      json.RawMessage `json:"id"`
+	JsonRpc string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *JsonRpcError   `json:"error,omitempty"`
+}
+
+type JsonRpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type irnPublishParams struct {
+	Topic   string `json:"topic"`
+	Message string `json:"message"`
+	TTL     int    `json:"ttl"`
+	Tag     int    `json:"tag"`
+	Prompt  bool   `json:"prompt"`
+}
+
+type irnSubscribeParams struct {
+	Topic string `json:"topic"`
+}
+
+type irnUnsubscribeParams struct {
+	Topic string `json:"topic"`
+	ID    string `json:"id"`
+}
+
+type irnBatchSubscribeParams struct {
+	Topics []string `json:"topics"`
+}
+
+type irnSubscriptionParams struct {
+	ID   string              `json:"id"`
+	Data irnSubscriptionData `json:"data"`
+}
+
+type irnSubscriptionData struct {
+	Topic       string `json:"topic"`
+	Message     string `json:"message"`
+	PublishedAt int64  `json:"publishedAt"`
+	Tag         int    `json:"tag"`
+}
+
+// rpcCall keeps the json-rpc request a SocketMessage is translated from, so that
+// the handler can reply to it
+type rpcCall struct {
+	id     json.RawMessage
+	topics []string // topics the request operates on
+}
+
+// detectProtocol infers the wire protocol from the first message of a connection
+func detectProtocol(m []byte) ProtocolVersion {
+	probe := struct {
+		JsonRpc string `json:"jsonrpc"`
+	}{}
+	if err := json.Unmarshal(m, &probe); err == nil && probe.JsonRpc == JsonRpcVersion {
+		return V2
+	}
+	return V1
+}
+
+// toSocketMessage translates an irn_* request into the SocketMessage handled by the wsserver
+func (req JsonRpcRequest) toSocketMessage() (SocketMessage, *JsonRpcError) {
+	call := &rpcCall{id: req.ID}
+	message := SocketMessage{Type: MessageType(req.Method), call: call}
+
+	var err error
+	switch message.Type {
+	case IrnPublish:
+		params := irnPublishParams{}
+		if err = json.Unmarshal(req.Params, &params); err == nil {
+			message.Topic, message.Payload, message.Tag, message.TTL = params.Topic, params.Message, params.Tag, params.TTL
+			// the wallet is woken up by push notifications only for the prompting messages
+			message.Silent = !params.Prompt
+			call.topics = []string{params.Topic}
+		}
+	case IrnSubscribe:
+		params := irnSubscribeParams{}
+		if err = json.Unmarshal(req.Params, &params); err == nil {
+			message.Topic = params.Topic
+			call.topics = []string{params.Topic}
+		}
+	case IrnUnsubscribe:
+		params := irnUnsubscribeParams{}
+		if err = json.Unmarshal(req.Params, &params); err == nil {
+			message.Topic = params.Topic
+			call.topics = []string{params.Topic}
+		}
+	case IrnBatchSubscribe:
+		params := irnBatchSubscribeParams{}
+		if err = json.Unmarshal(req.Params, &params); err == nil {
+			call.topics = params.Topics
+		}
+	default:
+		return message, &JsonRpcError{Code: JsonRpcMethodNotFound, Message: "method not found"}
+	}
+
+	if err != nil || len(call.topics) == 0 {
+		return message, &JsonRpcError{Code: JsonRpcInvalidParams, Message: "invalid params"}
+	}
+	for _, topic := range call.topics {
+		if topic == "" {
+			return message, &JsonRpcError{Code: JsonRpcInvalidParams, Message: "missing topic"}
+		}
+	}
+	return message, nil
+}
+
+// rpcReply builds a SocketMessage carrying the json-rpc response to the request `call`
+func rpcReply(call *rpcCall, result interface{}, rpcErr *JsonRpcError) SocketMessage {
+	var id json.RawMessage
+	if call != nil {
+		id = call.id
+	}
+	return SocketMessage{
+		reply: &JsonRpcResponse{
+			ID:      id,
+			JsonRpc: JsonRpcVersion,
+			Result:  result,
+			Error:   rpcErr,
+		},
+	}
+}
+
+// subscriptionID derives the v2 subscription id of a topic subscribed by the client,
+// it's stable for the lifetime of the connection so we needn't store it
+func subscriptionID(c *client, topic string) string {
+	sum := sha256.Sum256([]byte(c.id + topic))
+	return hex.EncodeToString(sum[:])
+}
+
+var rpcRequestSeq uint64
+
+// newRpcRequestID generates ids for relay initiated requests in the same way as the
+// WalletConnect sdk does, i.e. a timestamp followed by 3 extra digits
+func newRpcRequestID() json.RawMessage {
+	seq := atomic.AddUint64(&rpcRequestSeq, 1) % 1000
+	id := uint64(time.Now().UnixMilli())*1000 + seq
+	raw, _ := json.Marshal(id)
+	return raw
+}
+
+// encodeSubscription encodes a relayed "pub" message as an irn_subscription request to the subscriber
+func encodeSubscription(c *client, message SocketMessage) ([]byte, error) {
+	params, err := json.Marshal(irnSubscriptionParams{
+		ID: subscriptionID(c, message.Topic),
+		Data: irnSubscriptionData{
+			Topic:       message.Topic,
+			Message:     message.Payload,
+			PublishedAt: message.PublishedAt,
+			Tag:         message.Tag,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(JsonRpcRequest{
+		ID:      newRpcRequestID(),
+		JsonRpc: JsonRpcVersion,
+		Method:  string(IrnSubscription),
+		Params:  params,
+	})
+}
@@ -0,0 +1,95 @@
+package relay
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDetectProtocol(t *testing.T) {
+	v1 := `{"topic":"hello","type":"sub","payload":""}`
+	v2 := `{"id":1,"jsonrpc":"2.0","method":"irn_subscribe","params":{"topic":"hello"}}`
+
+	if actual := detectProtocol([]byte(v1)); actual != V1 {
+		t.Errorf("protocol error, expected: %v, actual: %v", V1, actual)
+	}
+	if actual := detectProtocol([]byte(v2)); actual != V2 {
+		t.Errorf("protocol error, expected: %v, actual: %v", V2, actual)
+	}
+}
+
+func TestRpcRequestToSocketMessage(t *testing.T) {
+	raw := `{"id":1680000000000123,"jsonrpc":"2.0","method":"irn_publish","params":{"topic":"hello","message":"world","ttl":300,"tag":1100}}`
+
+	req := JsonRpcRequest{}
+	if err := json.Unmarshal([]byte(raw), &req); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	message, rpcErr := req.toSocketMessage()
+	if rpcErr != nil {
+		t.Fatalf("unexpected error: %v", rpcErr)
+	}
+	// published without prompt, the wallet isn't woken up
+	if message.Type != IrnPublish || message.Topic != "hello" || message.Payload != "world" || message.Tag != 1100 || !message.Silent {
+		t.Errorf("translate error, actual: %+v", message)
+	}
+	if string(message.call.id) != "1680000000000123" {
+		t.Errorf("id error, expected: %v, actual: %v", "1680000000000123", string(message.call.id))
+	}
+
+	raw = `{"id":2,"jsonrpc":"2.0","method":"irn_batchSubscribe","params":{"topics":["hello","world"]}}`
+	req = JsonRpcRequest{}
+	if err := json.Unmarshal([]byte(raw), &req); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	message, rpcErr = req.toSocketMessage()
+	if rpcErr != nil {
+		t.Fatalf("unexpected error: %v", rpcErr)
+	}
+	if len(message.call.topics) != 2 {
+		t.Errorf("length error, expected: %v, actual: %v", 2, len(message.call.topics))
+	}
+}
+
+func TestRpcRequestInvalid(t *testing.T) {
+	cases := map[string]int{
+		`{"id":1,"jsonrpc":"2.0","method":"irn_foo","params":{}}`:                       JsonRpcMethodNotFound,
+		`{"id":1,"jsonrpc":"2.0","method":"irn_subscribe","params":{}}`:                 JsonRpcInvalidParams,
+		`{"id":1,"jsonrpc":"2.0","method":"irn_batchSubscribe","params":{"topics":[]}}`: JsonRpcInvalidParams,
+	}
+
+	for raw, expectedCode := range cases {
+		req := JsonRpcRequest{}
+		if err := json.Unmarshal([]byte(raw), &req); err != nil {
+			t.Fatalf("unmarshal error: %v", err)
+		}
+		_, rpcErr := req.toSocketMessage()
+		if rpcErr == nil || rpcErr.Code != expectedCode {
+			t.Errorf("error code error, expected: %v, actual: %v, request: %v", expectedCode, rpcErr, raw)
+		}
+	}
+}
+
+func TestEncodeSubscription(t *testing.T) {
+	c := &client{id: "1", protocol: V2}
+	m, err := c.encode(SocketMessage{Topic: "hello", Type: Pub, Payload: "world", PublishedAt: 1})
+	if err != nil {
+		t.Fatalf("encode error: %v", err)
+	}
+
+	req := JsonRpcRequest{}
+	if err := json.Unmarshal(m, &req); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	params := irnSubscriptionParams{}
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		t.Fatalf("unmarshal params error: %v", err)
+	}
+	if req.Method != string(IrnSubscription) || params.ID != subscriptionID(c, "hello") || params.Data.Message != "world" {
+		t.Errorf("encode error, actual: %v", string(m))
+	}
+
+	// v1 only messages are skipped for v2 clients
+	if m, _ := c.encode(SocketMessage{Type: Pong}); m != nil {
+		t.Errorf("expected nil, actual: %v", string(m))
+	}
+}
@@ -0,0 +1,428 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/RabbyHub/derelay/config"
+	"github.com/RabbyHub/derelay/log"
+	"go.uber.org/zap"
+)
+
+var errBackendClosed = errors.New("backend closed")
+
+// memoryBroker relays messages within a single relay node, it provides the same semantics
+// as the redis pub/sub channels without any external dependency
+type memoryBroker struct {
+	sync.RWMutex
+	channels map[string]struct{}
+
+	messages chan *BrokerMessage
+	done     chan struct{}
+	once     sync.Once
+}
+
+func NewMemoryBroker() Broker {
+	return &memoryBroker{
+		channels: map[string]struct{}{},
+		messages: make(chan *BrokerMessage, 100),
+		done:     make(chan struct{}),
+	}
+}
+
+func (mb *memoryBroker) Publish(ctx context.Context, channel string, message SocketMessage) (int64, error) {
+	mb.RLock()
+	_, subscribed := mb.channels[channel]
+	mb.RUnlock()
+	if !subscribed {
+		return 0, nil
+	}
+
+	payload, err := message.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+
+	// do not hold the lock while sending, the receiver may be subscribing channels
+	select {
+	case mb.messages <- &BrokerMessage{Channel: channel, Payload: string(payload)}:
+		return 1, nil
+	case <-mb.done:
+		return 0, errBackendClosed
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (mb *memoryBroker) Subscribe(ctx context.Context, channels ...string) error {
+	mb.Lock()
+	defer mb.Unlock()
+	for _, channel := range channels {
+		mb.channels[channel] = struct{}{}
+	}
+	return nil
+}
+
+func (mb *memoryBroker) Unsubscribe(ctx context.Context, channels ...string) error {
+	mb.Lock()
+	defer mb.Unlock()
+	if len(channels) == 0 {
+		mb.channels = map[string]struct{}{}
+		return nil
+	}
+	for _, channel := range channels {
+		delete(mb.channels, channel)
+	}
+	return nil
+}
+
+func (mb *memoryBroker) Presence(ctx context.Context, channel string) (int64, error) {
+	mb.RLock()
+	defer mb.RUnlock()
+	if _, ok := mb.channels[channel]; ok {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (mb *memoryBroker) Messages() <-chan *BrokerMessage {
+	return mb.messages
+}
+
+func (mb *memoryBroker) Ping(ctx context.Context) error {
+	select {
+	case <-mb.done:
+		return errBackendClosed
+	default:
+		return nil
+	}
+}
+
+func (mb *memoryBroker) Close() error {
+	mb.once.Do(func() {
+		close(mb.done)
+	})
+	return nil
+}
+
+// memoryMessageStore caches the messages in process, every message expires on its own, and the topic
+// expires with its last message
+type memoryMessageStore struct {
+	sync.Mutex
+	topics map[string]*memoryCacheEntry
+	quota  *config.CacheConfig
+	bytes  int64 // bytes of all of the cached messages
+
+	done chan struct{}
+	once sync.Once
+}
+
+type memoryCacheEntry struct {
+	messages []memoryCachedMessage
+	bytes    int
+	expireAt time.Time // when the last message expires
+}
+
+type memoryCachedMessage struct {
+	data     []byte // serialized like they are in redis, so that no client reference is kept
+	expireAt time.Time
+}
+
+// interval of purging the expired topics
+const memoryStorePurgeInterval = time.Minute
+
+func NewMemoryMessageStore(quota *config.CacheConfig) MessageStore {
+	store := &memoryMessageStore{
+		topics: map[string]*memoryCacheEntry{},
+		quota:  quota,
+		done:   make(chan struct{}),
+	}
+	go store.purge()
+	return store
+}
+
+func (ms *memoryMessageStore) purge() {
+	ticker := time.NewTicker(memoryStorePurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			ms.Lock()
+			for topic, entry := range ms.topics {
+				if !now.Before(entry.expireAt) {
+					ms.remove(topic)
+				}
+			}
+			ms.Unlock()
+		case <-ms.done:
+			return
+		}
+	}
+}
+
+// get returns the unexpired entry of the topic with the expired messages removed, must be called with the lock held
+func (ms *memoryMessageStore) get(topic string) *memoryCacheEntry {
+	entry, ok := ms.topics[topic]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if !now.Before(entry.expireAt) {
+		ms.remove(topic)
+		return nil
+	}
+
+	unexpired := entry.messages[:0:0]
+	for _, message := range entry.messages {
+		if now.Before(message.expireAt) {
+			unexpired = append(unexpired, message)
+			continue
+		}
+		entry.bytes -= len(message.data)
+		ms.bytes -= int64(len(message.data))
+	}
+	entry.messages = unexpired
+	return entry
+}
+
+// remove removes the entry of the topic, must be called with the lock held
+func (ms *memoryMessageStore) remove(topic string) {
+	if entry, ok := ms.topics[topic]; ok {
+		ms.bytes -= int64(entry.bytes)
+		delete(ms.topics, topic)
+	}
+}
+
+func (ms *memoryMessageStore) Append(ctx context.Context, topic string, message SocketMessage, ttl time.Duration) (int, error) {
+	m, err := message.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	size := len(m)
+	if ms.quota.MaxBytes > 0 && size > ms.quota.MaxBytes {
+		return 0, errCacheQuotaExceeded
+	}
+
+	ms.Lock()
+	defer ms.Unlock()
+	entry := ms.get(topic)
+	if entry == nil {
+		entry = &memoryCacheEntry{}
+	}
+
+	// find out the oldest messages to evict to make room for the new one
+	evicted, freed := 0, 0
+	for evicted < len(entry.messages) {
+		count, bytes := len(entry.messages)-evicted, entry.bytes-freed
+		if (ms.quota.MaxMessages <= 0 || count < ms.quota.MaxMessages) && (ms.quota.MaxBytes <= 0 || bytes+size <= ms.quota.MaxBytes) {
+			break
+		}
+		if ms.quota.EvictionPolicy == config.CacheRejectNewest {
+			return 0, errCacheQuotaExceeded
+		}
+		freed += len(entry.messages[evicted].data)
+		evicted++
+	}
+	if ms.quota.MemoryBudget > 0 && ms.bytes-int64(freed)+int64(size) > ms.quota.MemoryBudget {
+		return 0, errCacheBudgetExceeded
+	}
+
+	expireAt := time.Now().Add(ttl)
+	entry.messages = append(entry.messages[evicted:], memoryCachedMessage{data: m, expireAt: expireAt})
+	if expireAt.After(entry.expireAt) {
+		entry.expireAt = expireAt
+	}
+	entry.bytes += size - freed
+	ms.bytes += int64(size - freed)
+	ms.topics[topic] = entry
+	return evicted, nil
+}
+
+func (ms *memoryMessageStore) Drain(ctx context.Context, topic string) ([]SocketMessage, error) {
+	ms.Lock()
+	entry := ms.get(topic)
+	ms.remove(topic)
+	ms.Unlock()
+
+	if entry == nil {
+		return nil, nil
+	}
+	return decodeMemoryMessages(topic, entry.messages), nil
+}
+
+func (ms *memoryMessageStore) Range(ctx context.Context, topic string) ([]SocketMessage, error) {
+	ms.Lock()
+	entry := ms.get(topic)
+	var messages []memoryCachedMessage
+	if entry != nil {
+		// copy the slice header, the entry may be appended after unlocking
+		messages = entry.messages[:len(entry.messages):len(entry.messages)]
+	}
+	ms.Unlock()
+
+	return decodeMemoryMessages(topic, messages), nil
+}
+
+// decodeMemoryMessages deserializes the cached messages, the malformed ones are skipped
+func decodeMemoryMessages(topic string, cached []memoryCachedMessage) []SocketMessage {
+	messages := make([]SocketMessage, 0, len(cached))
+	for _, m := range cached {
+		var message SocketMessage
+		if err := json.Unmarshal(m.data, &message); err != nil {
+			log.Warn("skip malformed cached message", zap.String("topic", topic), zap.ByteString("raw", m.data), zap.Error(err))
+			continue
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+func (ms *memoryMessageStore) Delete(ctx context.Context, topic string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.remove(topic)
+	return nil
+}
+
+func (ms *memoryMessageStore) Close() error {
+	ms.once.Do(func() {
+		close(ms.done)
+	})
+	return nil
+}
+
+// memoryWebhookStore keeps the webhooks in process
+type memoryWebhookStore struct {
+	sync.Mutex
+	webhooks map[string]*memoryWebhook
+	purgedAt time.Time
+}
+
+type memoryWebhook struct {
+	registration WebhookRegistration
+	expireAt     time.Time
+}
+
+func NewMemoryWebhookStore() WebhookStore {
+	return &memoryWebhookStore{webhooks: map[string]*memoryWebhook{}, purgedAt: time.Now()}
+}
+
+func (mw *memoryWebhookStore) Register(ctx context.Context, registration WebhookRegistration, ttl time.Duration) error {
+	mw.Lock()
+	defer mw.Unlock()
+
+	now := time.Now()
+	// the expired webhooks are purged on registering, there's no need of another goroutine
+	if now.Sub(mw.purgedAt) >= memoryStorePurgeInterval {
+		for topic, webhook := range mw.webhooks {
+			if !now.Before(webhook.expireAt) {
+				delete(mw.webhooks, topic)
+			}
+		}
+		mw.purgedAt = now
+	}
+
+	if webhook, ok := mw.webhooks[registration.Topic]; ok && now.Before(webhook.expireAt) && webhook.registration.Token != registration.Token {
+		return errWebhookTaken
+	}
+	mw.webhooks[registration.Topic] = &memoryWebhook{registration: registration, expireAt: now.Add(ttl)}
+	return nil
+}
+
+func (mw *memoryWebhookStore) Get(ctx context.Context, topic string) (*WebhookRegistration, error) {
+	mw.Lock()
+	defer mw.Unlock()
+
+	webhook, ok := mw.webhooks[topic]
+	if !ok {
+		return nil, nil
+	}
+	if !time.Now().Before(webhook.expireAt) {
+		delete(mw.webhooks, topic)
+		return nil, nil
+	}
+	registration := webhook.registration
+	return &registration, nil
+}
+
+// memorySubscriberStore counts the subscribers in process
+type memorySubscriberStore struct {
+	sync.Mutex
+	topics   map[string]map[string]time.Time // the subscribers of the topics and when they expire
+	purgedAt time.Time
+}
+
+func NewMemorySubscriberStore() SubscriberStore {
+	return &memorySubscriberStore{topics: map[string]map[string]time.Time{}, purgedAt: time.Now()}
+}
+
+func (ms *memorySubscriberStore) Join(ctx context.Context, topic string, subscriber string, max int, ttl time.Duration) (bool, bool, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	now := time.Now()
+	// the expired subscribers are purged on joining, there's no need of another goroutine
+	if now.Sub(ms.purgedAt) >= memoryStorePurgeInterval {
+		for topic := range ms.topics {
+			ms.purge(topic, now)
+		}
+		ms.purgedAt = now
+	}
+	ms.purge(topic, now)
+
+	subscribers := ms.topics[topic]
+	_, joined := subscribers[subscriber]
+	if !joined && len(subscribers) >= max {
+		return false, false, nil
+	}
+	if subscribers == nil {
+		subscribers = map[string]time.Time{}
+		ms.topics[topic] = subscribers
+	}
+	subscribers[subscriber] = now.Add(ttl)
+	return true, joined, nil
+}
+
+// purge removes the expired subscribers of the topic, and the topic once it has no more subscribers
+func (ms *memorySubscriberStore) purge(topic string, now time.Time) {
+	for subscriber, expireAt := range ms.topics[topic] {
+		if !now.Before(expireAt) {
+			delete(ms.topics[topic], subscriber)
+		}
+	}
+	if len(ms.topics[topic]) == 0 {
+		delete(ms.topics, topic)
+	}
+}
+
+func (ms *memorySubscriberStore) Leave(ctx context.Context, topic string, subscribers ...string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, subscriber := range subscribers {
+		delete(ms.topics[topic], subscriber)
+	}
+	if len(ms.topics[topic]) == 0 {
+		delete(ms.topics, topic)
+	}
+	return nil
+}
+
+func (ms *memorySubscriberStore) Refresh(ctx context.Context, subscribers map[string][]string, ttl time.Duration) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	expireAt := time.Now().Add(ttl)
+	for topic, ids := range subscribers {
+		if ms.topics[topic] == nil {
+			ms.topics[topic] = map[string]time.Time{}
+		}
+		for _, id := range ids {
+			ms.topics[topic][id] = expireAt
+		}
+	}
+	return nil
+}
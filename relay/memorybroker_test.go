@@ -0,0 +1,132 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/RabbyHub/derelay/config"
+)
+
+func TestMemoryBrokerPublish(t *testing.T) {
+	broker := NewMemoryBroker()
+	defer broker.Close()
+	ctx := context.TODO()
+
+	message := SocketMessage{Topic: "hello", Type: Pub, Payload: "world"}
+	if count, err := broker.Publish(ctx, messageChanKey("hello"), message); count != 0 || err != nil {
+		t.Errorf("publish without subscriber error, count: %v, err: %v", count, err)
+	}
+
+	broker.Subscribe(ctx, messageChanKey("hello"))
+	if count, err := broker.Publish(ctx, messageChanKey("hello"), message); count != 1 || err != nil {
+		t.Errorf("publish error, count: %v, err: %v", count, err)
+	}
+	select {
+	case m := <-broker.Messages():
+		if m.Channel != messageChanKey("hello") {
+			t.Errorf("channel error, expected: %v, actual: %v", messageChanKey("hello"), m.Channel)
+		}
+	default:
+		t.Errorf("message not received")
+	}
+
+	// unsubscribe all of the channels
+	broker.Unsubscribe(ctx)
+	if count, _ := broker.Presence(ctx, messageChanKey("hello")); count != 0 {
+		t.Errorf("presence error, expected: %v, actual: %v", 0, count)
+	}
+}
+
+func TestMemoryMessageStore(t *testing.T) {
+	store := NewMemoryMessageStore(&config.CacheConfig{})
+	defer store.Close()
+	ctx := context.TODO()
+
+	store.Append(ctx, "hello", SocketMessage{Topic: "hello", Type: Pub, Payload: "1"}, time.Minute)
+	store.Append(ctx, "hello", SocketMessage{Topic: "hello", Type: Pub, Payload: "2"}, time.Minute)
+	store.Append(ctx, "expired", SocketMessage{Topic: "expired", Type: Pub, Payload: "1"}, 0)
+
+	// range doesn't clear the messages
+	for i := 0; i < 2; i++ {
+		if messages, _ := store.Range(ctx, "hello"); len(messages) != 2 {
+			t.Errorf("length error, expected: %v, actual: %v", 2, len(messages))
+		}
+	}
+
+	messages, err := store.Drain(ctx, "hello")
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("drain error, messages: %v, err: %v", messages, err)
+	}
+	if messages[0].Payload != "1" || messages[1].Payload != "2" {
+		t.Errorf("order error, actual: %v", messages)
+	}
+	if messages, _ := store.Drain(ctx, "hello"); len(messages) != 0 {
+		t.Errorf("length error, expected: %v, actual: %v", 0, len(messages))
+	}
+	if messages, _ := store.Drain(ctx, "expired"); len(messages) != 0 {
+		t.Errorf("length error, expected: %v, actual: %v", 0, len(messages))
+	}
+}
+
+func TestMemoryMessageStoreQuota(t *testing.T) {
+	ctx := context.TODO()
+	message := SocketMessage{Topic: "hello", Type: Pub, Payload: "1"}
+	size, _ := message.MarshalBinary()
+
+	// the oldest messages are evicted
+	store := NewMemoryMessageStore(&config.CacheConfig{MaxMessages: 2, EvictionPolicy: config.CacheEvictOldest})
+	defer store.Close()
+	for i := 0; i < 3; i++ {
+		message.Payload = fmt.Sprint(i)
+		evicted, err := store.Append(ctx, "hello", message, time.Minute)
+		if err != nil {
+			t.Fatalf("append error: %v", err)
+		}
+		if expected := i / 2; evicted != expected {
+			t.Errorf("evicted error, expected: %v, actual: %v", expected, evicted)
+		}
+	}
+	if messages, _ := store.Drain(ctx, "hello"); len(messages) != 2 || messages[0].Payload != "1" {
+		t.Errorf("drain error, actual: %v", messages)
+	}
+
+	// the newest message is rejected
+	store = NewMemoryMessageStore(&config.CacheConfig{MaxBytes: len(size), EvictionPolicy: config.CacheRejectNewest})
+	defer store.Close()
+	if _, err := store.Append(ctx, "hello", message, time.Minute); err != nil {
+		t.Fatalf("append error: %v", err)
+	}
+	if _, err := store.Append(ctx, "hello", message, time.Minute); err != errCacheQuotaExceeded {
+		t.Errorf("append error, expected: %v, actual: %v", errCacheQuotaExceeded, err)
+	}
+
+	// the budget is shared by the topics, and released once the messages are drained
+	store = NewMemoryMessageStore(&config.CacheConfig{MemoryBudget: int64(len(size)), EvictionPolicy: config.CacheEvictOldest})
+	defer store.Close()
+	store.Append(ctx, "hello", message, time.Minute)
+	if _, err := store.Append(ctx, "world", message, time.Minute); err != errCacheBudgetExceeded {
+		t.Errorf("append error, expected: %v, actual: %v", errCacheBudgetExceeded, err)
+	}
+	store.Drain(ctx, "hello")
+	if _, err := store.Append(ctx, "world", message, time.Minute); err != nil {
+		t.Errorf("append error: %v", err)
+	}
+}
+
+func TestMemoryMessageStorePerMessageExpiry(t *testing.T) {
+	store := NewMemoryMessageStore(&config.CacheConfig{})
+	defer store.Close()
+	ctx := context.TODO()
+
+	store.Append(ctx, "hello", SocketMessage{Topic: "hello", Type: Pub, Payload: "long"}, time.Minute)
+	store.Append(ctx, "hello", SocketMessage{Topic: "hello", Type: Pub, Payload: "short"}, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	// the short-lived message expires without taking the others with it
+	messages, _ := store.Drain(ctx, "hello")
+	if len(messages) != 1 || messages[0].Payload != "long" {
+		t.Errorf("drain error, actual: %v", messages)
+	}
+}
@@ -0,0 +1,87 @@
+package relay
+
+import (
+	"net/url"
+	"strings"
+)
+
+// originPattern is a parsed entry of `WsConfig.AllowedOrigins`, which could be
+//   - "*": any origin
+//   - "debank.com": exact host, with or without port
+//   - "*.debank.com": any subdomain of debank.com, the apex domain itself is not included
+//   - "https://debank.com", "https://*.debank.com": the same as above but restricted to the scheme
+type originPattern struct {
+	scheme   string // empty for any scheme
+	host     string // lower cased, without the wildcard prefix
+	wildcard bool
+}
+
+type originChecker struct {
+	allowAny   bool
+	allowEmpty bool // native mobile wallets don't send the Origin header
+	patterns   []originPattern
+}
+
+func newOriginChecker(allowedOrigins []string, allowEmpty bool) *originChecker {
+	oc := &originChecker{allowEmpty: allowEmpty}
+	for _, origin := range allowedOrigins {
+		origin = strings.ToLower(strings.TrimSpace(origin))
+		if origin == "" {
+			continue
+		}
+		if origin == "*" {
+			oc.allowAny = true
+			continue
+		}
+
+		pattern := originPattern{}
+		if scheme, host, found := strings.Cut(origin, "://"); found {
+			pattern.scheme, origin = scheme, host
+		}
+		origin = strings.TrimSuffix(origin, "/")
+		if strings.HasPrefix(origin, "*.") {
+			pattern.wildcard, origin = true, origin[1:] // keep the leading dot
+		}
+		pattern.host = origin
+		oc.patterns = append(oc.patterns, pattern)
+	}
+	return oc
+}
+
+// check tells whether the value of the Origin header is allowed
+func (oc *originChecker) check(origin string) bool {
+	if origin == "" {
+		return oc.allowEmpty
+	}
+	if oc.allowAny {
+		return true
+	}
+
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, pattern := range oc.patterns {
+		if pattern.match(u) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p originPattern) match(u *url.URL) bool {
+	if p.scheme != "" && p.scheme != u.Scheme {
+		return false
+	}
+
+	// only compare the port when the pattern specifies one
+	host := u.Hostname()
+	if strings.Contains(p.host, ":") {
+		host = u.Host
+	}
+
+	if p.wildcard {
+		return strings.HasSuffix(host, p.host)
+	}
+	return host == p.host
+}
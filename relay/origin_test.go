@@ -0,0 +1,46 @@
+package relay
+
+import "testing"
+
+func TestOriginChecker(t *testing.T) {
+	oc := newOriginChecker([]string{"debank.com", "*.rabby.io", "https://app.example.com", "localhost:3000"}, false)
+
+	cases := map[string]bool{
+		"https://debank.com":          true,
+		"http://debank.com":           true,
+		"https://DeBank.com":          true,
+		"https://debank.com:8443":     true,
+		"https://api.debank.com":      false,
+		"https://rabby.io":            false,
+		"https://app.rabby.io":        true,
+		"https://a.b.rabby.io":        true,
+		"https://evilrabby.io":        false,
+		"https://app.example.com":     true,
+		"http://app.example.com":      false,
+		"http://localhost:3000":       true,
+		"http://localhost:3001":       false,
+		"":                            false,
+		"null":                        false,
+		"https://debank.com.evil.com": false,
+	}
+	for origin, expected := range cases {
+		if actual := oc.check(origin); actual != expected {
+			t.Errorf("check origin %q error, expected: %v, actual: %v", origin, expected, actual)
+		}
+	}
+}
+
+func TestOriginCheckerAllowAny(t *testing.T) {
+	oc := newOriginChecker([]string{"*"}, true)
+	if !oc.check("https://anything.com") {
+		t.Errorf("any origin should be allowed")
+	}
+	if !oc.check("") {
+		t.Errorf("empty origin should be allowed")
+	}
+
+	oc = newOriginChecker([]string{"*"}, false)
+	if oc.check("") {
+		t.Errorf("empty origin should not be allowed")
+	}
+}
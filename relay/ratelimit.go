@@ -0,0 +1,178 @@
+package relay
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RabbyHub/derelay/log"
+	"go.uber.org/zap"
+)
+
+// the close code sent to the clients keep exceeding the rate limit
+const closeRateLimited = 4029
+
+// idle buckets are swept at this interval
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket allows `rate` events per second on average and bursts of up to `burst` events,
+// a nil bucket allows everything
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// allow takes a token from the bucket if there's any
+func (tb *tokenBucket) allow(now time.Time) bool {
+	if tb == nil {
+		return true
+	}
+	tb.Lock()
+	defer tb.Unlock()
+	tb.refill(now)
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// full tells whether the bucket has been refilled, i.e. it's the same as a new one
+func (tb *tokenBucket) full(now time.Time) bool {
+	tb.Lock()
+	defer tb.Unlock()
+	tb.refill(now)
+	return tb.tokens >= tb.burst
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	if !tb.last.IsZero() {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+	}
+	tb.last = now
+}
+
+// keyedLimiter keeps a token bucket for each key, e.g. the client ip, a nil limiter allows everything
+type keyedLimiter struct {
+	sync.Mutex
+	rate      float64
+	burst     int
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newKeyedLimiter(rate float64, burst int) *keyedLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &keyedLimiter{rate: rate, burst: burst, buckets: map[string]*tokenBucket{}, lastSweep: time.Now()}
+}
+
+// allow takes a token from the bucket of the key
+func (kl *keyedLimiter) allow(key string, now time.Time) bool {
+	if kl == nil {
+		return true
+	}
+	kl.Lock()
+	if now.Sub(kl.lastSweep) > rateLimitSweepInterval {
+		kl.sweep(now)
+	}
+	bucket, ok := kl.buckets[key]
+	if !ok {
+		bucket = newTokenBucket(kl.rate, kl.burst)
+		kl.buckets[key] = bucket
+	}
+	kl.Unlock()
+	return bucket.allow(now)
+}
+
+// sweep forgets the buckets which have been refilled, the limiter must be locked
+func (kl *keyedLimiter) sweep(now time.Time) {
+	for key, bucket := range kl.buckets {
+		if bucket.full(now) {
+			delete(kl.buckets, key)
+		}
+	}
+	kl.lastSweep = now
+}
+
+// parseTrustedProxies parses the ips and cidrs of `WsConfig.TrustedProxies`
+func parseTrustedProxies(proxies []string) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			log.Warn("invalid trusted proxy", zap.String("proxy", proxy), zap.Error(err))
+			continue
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets
+}
+
+func isTrustedProxy(ip string, proxies []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		if proxy.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the ip of the client, the X-Forwarded-For header is only honored if the request
+// comes from a trusted proxy, then the rightmost untrusted address in the header is the client
+func clientIP(r *http.Request, proxies []*net.IPNet) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrustedProxy(ip, proxies) {
+		return ip
+	}
+
+	forwarded := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(header, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				forwarded = append(forwarded, addr)
+			}
+		}
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip = forwarded[i]
+		if !isTrustedProxy(ip, proxies) {
+			break
+		}
+	}
+	return ip
+}
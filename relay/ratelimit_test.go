@@ -0,0 +1,108 @@
+package relay
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/RabbyHub/derelay/config"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	tb := newTokenBucket(2, 3)
+
+	for i := 0; i < 3; i++ {
+		if !tb.allow(now) {
+			t.Errorf("burst should be allowed, event: %v", i)
+		}
+	}
+	if tb.allow(now) {
+		t.Errorf("event should be limited after the burst")
+	}
+	// refilled 1 token in half a second
+	if !tb.allow(now.Add(500 * time.Millisecond)) {
+		t.Errorf("event should be allowed after refilling")
+	}
+	if tb.allow(now.Add(500 * time.Millisecond)) {
+		t.Errorf("event should be limited")
+	}
+
+	unlimited := newTokenBucket(0, 0)
+	if !unlimited.allow(now) {
+		t.Errorf("unlimited bucket should allow everything")
+	}
+}
+
+func TestKeyedLimiter(t *testing.T) {
+	now := time.Now()
+	kl := newKeyedLimiter(1, 1)
+
+	if !kl.allow("1.1.1.1", now) || kl.allow("1.1.1.1", now) {
+		t.Errorf("the key should be limited after its burst")
+	}
+	if !kl.allow("2.2.2.2", now) {
+		t.Errorf("the keys should be limited separately")
+	}
+
+	// the refilled buckets are forgotten
+	kl.allow("3.3.3.3", now.Add(2*rateLimitSweepInterval))
+	if len(kl.buckets) != 1 {
+		t.Errorf("length error, expected: %v, actual: %v", 1, len(kl.buckets))
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	cases := []struct {
+		remote    string
+		forwarded string
+		expected  string
+	}{
+		{"1.2.3.4:5678", "", "1.2.3.4"},
+		// untrusted remote, the header is ignored
+		{"1.2.3.4:5678", "5.6.7.8", "1.2.3.4"},
+		{"10.1.1.1:5678", "5.6.7.8", "5.6.7.8"},
+		// the spoofed addresses on the left are ignored
+		{"10.1.1.1:5678", "9.9.9.9, 5.6.7.8, 192.168.1.1", "5.6.7.8"},
+		{"192.168.1.1:5678", "", "192.168.1.1"},
+	}
+	for _, c := range cases {
+		r := &http.Request{RemoteAddr: c.remote, Header: http.Header{}}
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if actual := clientIP(r, proxies); actual != c.expected {
+			t.Errorf("ip error, remote: %v, forwarded: %v, expected: %v, actual: %v", c.remote, c.forwarded, c.expected, actual)
+		}
+	}
+}
+
+func TestClientRateLimited(t *testing.T) {
+	conf := config.LoadConfig("")
+	conf.WsServerConfig.RateLimitViolations = 2
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+
+	c := newTestClient(ws)
+	c.closing = make(chan struct{})
+	c.limiter = newTokenBucket(1, 1)
+
+	message := SocketMessage{Topic: "hello", Type: Pub, Payload: "world", client: c}
+	if !c.allow(message) {
+		t.Errorf("first message should be allowed")
+	}
+	if c.allow(message) {
+		t.Errorf("second message should be limited")
+	}
+	if reply := <-c.sendbuf; reply.Type != Error || reply.Code != ErrorRateLimited || reply.Topic != "hello" {
+		t.Errorf("rate limit error should be sent, actual: %+v", reply)
+	}
+
+	c.allow(message)
+	select {
+	case <-c.closing:
+	default:
+		t.Errorf("client should be closed after %v violations", 2)
+	}
+}
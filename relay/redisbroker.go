@@ -0,0 +1,642 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RabbyHub/derelay/config"
+	"github.com/RabbyHub/derelay/log"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// redisBroker relays messages among the relay nodes through redis pub/sub
+type redisBroker struct {
+	conn    redis.UniversalClient
+	subConn *redis.PubSub
+
+	messages chan *BrokerMessage
+}
+
+func NewRedisBroker(conn redis.UniversalClient) Broker {
+	broker := &redisBroker{
+		conn:     conn,
+		subConn:  conn.Subscribe(context.TODO()),
+		messages: make(chan *BrokerMessage, 100),
+	}
+	go broker.receive()
+	return broker
+}
+
+func (rb *redisBroker) receive() {
+	for m := range rb.subConn.Channel() {
+		rb.messages <- &BrokerMessage{Channel: m.Channel, Payload: m.Payload}
+	}
+	close(rb.messages)
+}
+
+func (rb *redisBroker) Publish(ctx context.Context, channel string, message SocketMessage) (int64, error) {
+	return rb.conn.Publish(ctx, channel, message).Result()
+}
+
+func (rb *redisBroker) Subscribe(ctx context.Context, channels ...string) error {
+	return rb.subConn.Subscribe(ctx, channels...)
+}
+
+func (rb *redisBroker) Unsubscribe(ctx context.Context, channels ...string) error {
+	return rb.subConn.Unsubscribe(ctx, channels...)
+}
+
+func (rb *redisBroker) Presence(ctx context.Context, channel string) (int64, error) {
+	counts, err := rb.conn.PubSubNumSub(ctx, channel).Result()
+	if err != nil {
+		return 0, err
+	}
+	return counts[channel], nil
+}
+
+func (rb *redisBroker) Messages() <-chan *BrokerMessage {
+	return rb.messages
+}
+
+func (rb *redisBroker) Ping(ctx context.Context) error {
+	return rb.conn.Ping(ctx).Err()
+}
+
+func (rb *redisBroker) Close() error {
+	return rb.subConn.Close()
+}
+
+// redisShardedBroker relays messages among the relay nodes through the sharded pub/sub of redis cluster(redis 7+)
+//
+// NOTE the channels subscribed by one connection must belong to the same hash slot, otherwise SSUBSCRIBE fails
+// with CROSSSLOT, so the channels are spread over a fixed number of shards with hash tags, and every shard is
+// subscribed by its own connection to the master node owning it
+type redisShardedBroker struct {
+	sync.Mutex
+	conn      *redis.ClusterClient
+	shards    map[int]*pubSubShard
+	closed    bool
+	receivers sync.WaitGroup // the goroutines receiving the messages of the shards
+
+	messages chan *BrokerMessage
+}
+
+// pubSubShard is the connection subscribing the channels of a shard
+type pubSubShard struct {
+	subConn *redis.PubSub
+	addr    string // the master node owning the shard when it's subscribed
+}
+
+// number of shards the channels are spread over
+const shardedPubSubShards = 64
+
+var errBrokerClosed = errors.New("broker closed")
+
+func NewRedisShardedBroker(conn *redis.ClusterClient) Broker {
+	return &redisShardedBroker{
+		conn:     conn,
+		shards:   map[int]*pubSubShard{},
+		messages: make(chan *BrokerMessage, 100),
+	}
+}
+
+// shardKey returns the hash tag of the shard, all of the channels of the shard belong to its slot
+func shardKey(shard int) string {
+	return fmt.Sprintf("{derelay:%d}", shard)
+}
+
+// shardChannel returns the shard of the channel and the channel name tagged with the shard
+func shardChannel(channel string) (int, string) {
+	shard := int(crc32.ChecksumIEEE([]byte(channel)) % shardedPubSubShards)
+	return shard, shardKey(shard) + channel
+}
+
+// unshardChannel is the reverse of `shardChannel`
+func unshardChannel(sharded string) string {
+	if i := strings.Index(sharded, "}"); i >= 0 {
+		return sharded[i+1:]
+	}
+	return sharded
+}
+
+func (rb *redisShardedBroker) receive(subConn *redis.PubSub) {
+	defer rb.receivers.Done()
+	for m := range subConn.Channel() {
+		rb.messages <- &BrokerMessage{Channel: unshardChannel(m.Channel), Payload: m.Payload}
+	}
+}
+
+// shard returns the subscription connection of the shard, it's connected to the current master of the shard
+// if there's none. it must be called with the lock held
+func (rb *redisShardedBroker) shard(ctx context.Context, shard int) (*pubSubShard, error) {
+	if rb.closed {
+		return nil, errBrokerClosed
+	}
+	if ps, ok := rb.shards[shard]; ok {
+		return ps, nil
+	}
+
+	node, err := rb.conn.MasterForKey(ctx, shardKey(shard))
+	if err != nil {
+		return nil, err
+	}
+	ps := &pubSubShard{subConn: node.SSubscribe(ctx), addr: node.Options().Addr}
+	rb.shards[shard] = ps
+	rb.receivers.Add(1)
+	go rb.receive(ps.subConn)
+	return ps, nil
+}
+
+// dropShard closes the subscription connection of the shard, so that the channels of the shard are
+// subscribed on its current master next time. it must be called with the lock held
+func (rb *redisShardedBroker) dropShard(shard int) {
+	if ps, ok := rb.shards[shard]; ok {
+		ps.subConn.Close()
+		delete(rb.shards, shard)
+	}
+}
+
+func (rb *redisShardedBroker) Publish(ctx context.Context, channel string, message SocketMessage) (int64, error) {
+	_, sharded := shardChannel(channel)
+	return rb.conn.SPublish(ctx, sharded, message).Result()
+}
+
+func (rb *redisShardedBroker) Subscribe(ctx context.Context, channels ...string) error {
+	rb.Lock()
+	defer rb.Unlock()
+
+	for _, channel := range channels {
+		shard, sharded := shardChannel(channel)
+		ps, err := rb.shard(ctx, shard)
+		if err != nil {
+			return err
+		}
+		if err := ps.subConn.SSubscribe(ctx, sharded); err != nil {
+			// e.g. the master has gone, which is resolved again next time
+			rb.dropShard(shard)
+			return err
+		}
+	}
+	return nil
+}
+
+func (rb *redisShardedBroker) Unsubscribe(ctx context.Context, channels ...string) error {
+	rb.Lock()
+	defer rb.Unlock()
+
+	if len(channels) == 0 {
+		for _, ps := range rb.shards {
+			if err := ps.subConn.SUnsubscribe(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, channel := range channels {
+		shard, sharded := shardChannel(channel)
+		if ps, ok := rb.shards[shard]; ok {
+			if err := ps.subConn.SUnsubscribe(ctx, sharded); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (rb *redisShardedBroker) Presence(ctx context.Context, channel string) (int64, error) {
+	_, sharded := shardChannel(channel)
+	node, err := rb.conn.MasterForKey(ctx, sharded)
+	if err != nil {
+		return 0, err
+	}
+	counts, err := node.PubSubShardNumSub(ctx, sharded).Result()
+	if err != nil {
+		return 0, err
+	}
+	return counts[sharded], nil
+}
+
+func (rb *redisShardedBroker) Messages() <-chan *BrokerMessage {
+	return rb.messages
+}
+
+// Ping checks the masters, and whether the shards are still served by the masters they're subscribed on.
+//
+// NOTE the subscriptions of a shard are lost once its slot moves to another master, e.g. after a failover
+// or a slot migration, so the shard is dropped and an error is returned, then its channels are subscribed
+// again on the new master as the broker recovers
+func (rb *redisShardedBroker) Ping(ctx context.Context) error {
+	err := rb.conn.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		return node.Ping(ctx).Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	rb.Lock()
+	defer rb.Unlock()
+	moved := []int{}
+	for shard, ps := range rb.shards {
+		node, err := rb.conn.MasterForKey(ctx, shardKey(shard))
+		if err != nil {
+			return err
+		}
+		if node.Options().Addr != ps.addr {
+			rb.dropShard(shard)
+			moved = append(moved, shard)
+		}
+	}
+	if len(moved) > 0 {
+		return fmt.Errorf("shards %v moved to other masters", moved)
+	}
+	return nil
+}
+
+// Close closes the subscription connections, and the message channel once the messages received are consumed
+func (rb *redisShardedBroker) Close() error {
+	rb.Lock()
+	defer rb.Unlock()
+	if rb.closed {
+		return nil
+	}
+	rb.closed = true
+	for shard := range rb.shards {
+		rb.dropShard(shard)
+	}
+	go func() {
+		rb.receivers.Wait()
+		close(rb.messages)
+	}()
+	return nil
+}
+
+// redisMessageStore caches the messages in redis lists
+//
+// for the memory budget, the bytes of the cached messages are counted in the `cachedBytesKey` hash by the
+// minute they expire, so that the expired messages no longer count without tracking every expiring list
+type redisMessageStore struct {
+	conn  redis.UniversalClient
+	quota *config.CacheConfig
+
+	// bytes of the cached messages, sampled for checking the memory budget
+	sampleLock    sync.Mutex
+	cachedBytes   int64
+	cachedBytesAt time.Time
+}
+
+// interval of sampling the bytes of the cached messages
+const cachedBytesSampleInterval = time.Second
+
+func NewRedisMessageStore(conn redis.UniversalClient, quota *config.CacheConfig) MessageStore {
+	return &redisMessageStore{conn: conn, quota: quota}
+}
+
+// appendScript caches the message within the quota of the topic, returns the number of the messages evicted
+// followed by the expiry and the size of each message removed, or -1 if the message is rejected
+//
+// the expired messages are removed first, and the list is kept until its last message expires
+var appendScript = redis.NewScript(`
+local size = string.len(ARGV[1])
+local ttl = tonumber(ARGV[2])
+local maxMessages = tonumber(ARGV[3])
+local maxBytes = tonumber(ARGV[4])
+local now = tonumber(ARGV[6])
+if maxBytes > 0 and size > maxBytes then
+	return {-1}
+end
+
+local result = {0}
+if maxMessages > 0 or maxBytes > 0 then
+	local messages = {}
+	local expiries = {}
+	local bytes = size
+	for _, m in ipairs(redis.call("LRANGE", KEYS[1], 0, -1)) do
+		local ok, decoded = pcall(cjson.decode, m)
+		local expireAt = ok and type(decoded) == "table" and tonumber(decoded["expireAt"]) or 0
+		if expireAt > 0 and expireAt <= now then
+			redis.call("LREM", KEYS[1], 1, m)
+			table.insert(result, expireAt)
+			table.insert(result, string.len(m))
+		else
+			table.insert(messages, m)
+			table.insert(expiries, expireAt)
+			bytes = bytes + string.len(m)
+		end
+	end
+
+	local count = #messages
+	local evicted = 0
+	while count > 0 and ((maxMessages > 0 and count >= maxMessages) or (maxBytes > 0 and bytes > maxBytes)) do
+		if ARGV[5] == "1" then
+			return {-1}
+		end
+		evicted = evicted + 1
+		bytes = bytes - string.len(messages[evicted])
+		count = count - 1
+		table.insert(result, expiries[evicted])
+		table.insert(result, string.len(messages[evicted]))
+	end
+	if evicted > 0 then
+		redis.call("LTRIM", KEYS[1], evicted, -1)
+	end
+	result[1] = evicted
+end
+
+redis.call("RPUSH", KEYS[1], ARGV[1])
+if redis.call("PTTL", KEYS[1]) < ttl then
+	redis.call("PEXPIRE", KEYS[1], ttl)
+end
+return result
+`)
+
+func (rs *redisMessageStore) Append(ctx context.Context, topic string, message SocketMessage, ttl time.Duration) (int, error) {
+	if rs.overBudget(ctx) {
+		return 0, errCacheBudgetExceeded
+	}
+
+	// the expiry tells which minute the bytes of the message are counted in
+	now := time.Now()
+	if message.ExpireAt == 0 {
+		message.ExpireAt = now.Add(ttl).UnixMilli()
+	}
+	payload, err := message.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	reject := "0"
+	if rs.quota.EvictionPolicy == config.CacheRejectNewest {
+		reject = "1"
+	}
+	result, err := appendScript.Run(ctx, rs.conn, []string{cachedMessageKey(topic)},
+		payload, ttl.Milliseconds(), rs.quota.MaxMessages, rs.quota.MaxBytes, reject, now.UnixMilli()).Int64Slice()
+	if err != nil {
+		return 0, err
+	}
+	if result[0] < 0 {
+		return 0, errCacheQuotaExceeded
+	}
+
+	counts := map[int64]int64{expiryMinute(message.ExpireAt): int64(len(payload))}
+	for i := 1; i+1 < len(result); i += 2 {
+		counts[expiryMinute(result[i])] -= result[i+1]
+	}
+	rs.countBytes(ctx, counts)
+	return int(result[0]), nil
+}
+
+// expiryMinute returns the field of `cachedBytesKey` counting the messages expiring at `expireAt`(in milliseconds)
+func expiryMinute(expireAt int64) int64 {
+	return expireAt / time.Minute.Milliseconds()
+}
+
+// countBytes adds the bytes of the messages cached or removed to `cachedBytesKey`, by the minute they expire
+func (rs *redisMessageStore) countBytes(ctx context.Context, counts map[int64]int64) {
+	if rs.quota.MemoryBudget <= 0 {
+		return
+	}
+	_, err := rs.conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for minute, bytes := range counts {
+			if bytes != 0 {
+				pipe.HIncrBy(ctx, cachedBytesKey, strconv.FormatInt(minute, 10), bytes)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn("count cached bytes fail", zap.Error(err))
+	}
+}
+
+// uncount removes the bytes of the messages no longer cached from `cachedBytesKey`
+func (rs *redisMessageStore) uncount(ctx context.Context, notificationBytes []string) {
+	counts := map[int64]int64{}
+	for _, nb := range notificationBytes {
+		var n SocketMessage
+		if err := json.Unmarshal([]byte(nb), &n); err != nil || n.ExpireAt == 0 {
+			continue
+		}
+		counts[expiryMinute(n.ExpireAt)] -= int64(len(nb))
+	}
+	rs.countBytes(ctx, counts)
+}
+
+// overBudget checks whether the cached messages exceed the memory budget, their bytes are sampled at most
+// once per `cachedBytesSampleInterval`, the messages are still cached if they fail to be sampled
+func (rs *redisMessageStore) overBudget(ctx context.Context) bool {
+	if rs.quota.MemoryBudget <= 0 {
+		return false
+	}
+
+	rs.sampleLock.Lock()
+	defer rs.sampleLock.Unlock()
+	if time.Since(rs.cachedBytesAt) >= cachedBytesSampleInterval {
+		cachedBytes, err := rs.sampleCachedBytes(ctx)
+		if err != nil {
+			log.Warn("sample cached bytes fail", zap.Error(err))
+		}
+		rs.cachedBytes, rs.cachedBytesAt = cachedBytes, time.Now()
+	}
+	return rs.cachedBytes > rs.quota.MemoryBudget
+}
+
+// sampleCachedBytes sums up the bytes of the messages not expired yet, and forgets the expired ones
+func (rs *redisMessageStore) sampleCachedBytes(ctx context.Context) (int64, error) {
+	counts, err := rs.conn.HGetAll(ctx, cachedBytesKey).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	now := expiryMinute(time.Now().UnixMilli())
+	var total int64
+	expired := []string{}
+	for field, value := range counts {
+		minute, _ := strconv.ParseInt(field, 10, 64)
+		if minute < now {
+			expired = append(expired, field)
+			continue
+		}
+		bytes, _ := strconv.ParseInt(value, 10, 64)
+		total += bytes
+	}
+	if len(expired) > 0 {
+		rs.conn.HDel(ctx, cachedBytesKey, expired...)
+	}
+	return total, nil
+}
+
+// drainScript gets and clears the cached messages in one go, so that neither the messages pushed in between
+// are lost, nor the messages are received by multiple subscribers
+var drainScript = redis.NewScript(`
+local messages = redis.call("LRANGE", KEYS[1], 0, -1)
+redis.call("DEL", KEYS[1])
+return messages
+`)
+
+func (rs *redisMessageStore) Drain(ctx context.Context, topic string) ([]SocketMessage, error) {
+	notificationBytes, err := drainScript.Run(ctx, rs.conn, []string{cachedMessageKey(topic)}).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	rs.uncount(ctx, notificationBytes)
+	return decodeCachedMessages(topic, notificationBytes), nil
+}
+
+func (rs *redisMessageStore) Range(ctx context.Context, topic string) ([]SocketMessage, error) {
+	notificationBytes, err := rs.conn.LRange(ctx, cachedMessageKey(topic), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeCachedMessages(topic, notificationBytes), nil
+}
+
+// decodeCachedMessages deserializes the cached messages, the malformed and expired ones are skipped
+func decodeCachedMessages(topic string, notificationBytes []string) []SocketMessage {
+	now := time.Now()
+	notifications := make([]SocketMessage, 0, len(notificationBytes))
+	for _, nb := range notificationBytes {
+		var n SocketMessage
+		if err := json.Unmarshal([]byte(nb), &n); err != nil {
+			log.Warn("skip malformed cached message", zap.String("topic", topic), zap.String("raw", nb), zap.Error(err))
+			continue
+		}
+		if n.expired(now) {
+			continue
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications
+}
+
+func (rs *redisMessageStore) Delete(ctx context.Context, topic string) error {
+	notificationBytes, err := drainScript.Run(ctx, rs.conn, []string{cachedMessageKey(topic)}).StringSlice()
+	if err != nil {
+		return err
+	}
+	rs.uncount(ctx, notificationBytes)
+	return nil
+}
+
+func (rs *redisMessageStore) Close() error {
+	return rs.conn.Close()
+}
+
+// redisWebhookStore keeps the webhooks in redis, so that they're shared by the relay nodes
+type redisWebhookStore struct {
+	conn redis.UniversalClient
+}
+
+func NewRedisWebhookStore(conn redis.UniversalClient) WebhookStore {
+	return &redisWebhookStore{conn: conn}
+}
+
+// registerScript registers the webhook unless the topic has been registered with another token,
+// returns 0 if it's taken
+var registerScript = redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if current then
+	local ok, decoded = pcall(cjson.decode, current)
+	if ok and type(decoded) == "table" and decoded["token"] ~= ARGV[2] then
+		return 0
+	end
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[3])
+return 1
+`)
+
+func (rw *redisWebhookStore) Register(ctx context.Context, registration WebhookRegistration, ttl time.Duration) error {
+	value, err := json.Marshal(registration)
+	if err != nil {
+		return err
+	}
+	registered, err := registerScript.Run(ctx, rw.conn, []string{webhookKey(registration.Topic)},
+		value, registration.Token, ttl.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if registered == 0 {
+		return errWebhookTaken
+	}
+	return nil
+}
+
+func (rw *redisWebhookStore) Get(ctx context.Context, topic string) (*WebhookRegistration, error) {
+	value, err := rw.conn.Get(ctx, webhookKey(topic)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	registration := &WebhookRegistration{}
+	if err := json.Unmarshal(value, registration); err != nil {
+		return nil, err
+	}
+	return registration, nil
+}
+
+// redisSubscriberStore counts the subscribers in redis, so that they're limited across the relay nodes
+type redisSubscriberStore struct {
+	conn redis.UniversalClient
+}
+
+func NewRedisSubscriberStore(conn redis.UniversalClient) SubscriberStore {
+	return &redisSubscriberStore{conn: conn}
+}
+
+// joinScript purges the expired subscribers, then adds the subscriber unless the topic is full,
+// returns 0 if it's full, 1 if the subscriber is added, 2 if it has joined before
+var joinScript = redis.NewScript(`
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[3])
+local joined = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if not joined and redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], tonumber(ARGV[3]) + tonumber(ARGV[4]), ARGV[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+if joined then
+	return 2
+end
+return 1
+`)
+
+func (rs *redisSubscriberStore) Join(ctx context.Context, topic string, subscriber string, max int, ttl time.Duration) (bool, bool, error) {
+	joined, err := joinScript.Run(ctx, rs.conn, []string{subscribersKey(topic)},
+		subscriber, max, time.Now().UnixMilli(), ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, false, err
+	}
+	return joined > 0, joined == 2, nil
+}
+
+func (rs *redisSubscriberStore) Leave(ctx context.Context, topic string, subscribers ...string) error {
+	members := make([]interface{}, 0, len(subscribers))
+	for _, subscriber := range subscribers {
+		members = append(members, subscriber)
+	}
+	return rs.conn.ZRem(ctx, subscribersKey(topic), members...).Err()
+}
+
+func (rs *redisSubscriberStore) Refresh(ctx context.Context, subscribers map[string][]string, ttl time.Duration) error {
+	expireAt := float64(time.Now().Add(ttl).UnixMilli())
+	_, err := rs.conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for topic, ids := range subscribers {
+			members := make([]redis.Z, 0, len(ids))
+			for _, id := range ids {
+				members = append(members, redis.Z{Score: expireAt, Member: id})
+			}
+			pipe.ZAdd(ctx, subscribersKey(topic), members...)
+			pipe.PExpire(ctx, subscribersKey(topic), ttl)
+		}
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,201 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/RabbyHub/derelay/config"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedis connects to an in-process redis server which is stopped when the test ends
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, redis.UniversalClient) {
+	server := miniredis.RunT(t)
+	conn := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { conn.Close() })
+	return server, conn
+}
+
+func TestShardChannel(t *testing.T) {
+	channel := messageChanKey("70a69a10-d3ca-43e8-a418-f6d6e6470969")
+
+	shard, sharded := shardChannel(channel)
+	if shard < 0 || shard >= shardedPubSubShards {
+		t.Errorf("shard out of range: %v", shard)
+	}
+	if actual := unshardChannel(sharded); actual != channel {
+		t.Errorf("unshard error, expected: %v, actual: %v", channel, actual)
+	}
+
+	// the same channel always goes to the same shard
+	if anotherShard, anotherSharded := shardChannel(channel); anotherShard != shard || anotherSharded != sharded {
+		t.Errorf("shard error, expected: %v, actual: %v", sharded, anotherSharded)
+	}
+}
+
+func TestDecodeCachedMessagesSkipsMalformed(t *testing.T) {
+	valid, _ := SocketMessage{Topic: "hello", Type: Pub, Payload: "world"}.MarshalBinary()
+	messages := decodeCachedMessages("hello", []string{string(valid), "{malformed", string(valid)})
+	if len(messages) != 2 {
+		t.Errorf("length error, expected: %v, actual: %v", 2, len(messages))
+	}
+}
+
+func TestDecodeCachedMessagesSkipsExpired(t *testing.T) {
+	expired, _ := SocketMessage{Topic: "hello", Type: Pub, ExpireAt: time.Now().Add(-time.Second).UnixMilli()}.MarshalBinary()
+	unexpired, _ := SocketMessage{Topic: "hello", Type: Pub, ExpireAt: time.Now().Add(time.Minute).UnixMilli()}.MarshalBinary()
+	if messages := decodeCachedMessages("hello", []string{string(expired), string(unexpired)}); len(messages) != 1 {
+		t.Errorf("length error, expected: %v, actual: %v", 1, len(messages))
+	}
+}
+
+func TestRedisMessageStoreQuota(t *testing.T) {
+	_, conn := newTestRedis(t)
+	ctx := context.TODO()
+	message := SocketMessage{Topic: "hello", Type: Pub, Payload: "1", ExpireAt: time.Now().Add(time.Minute).UnixMilli()}
+	size, _ := message.MarshalBinary()
+
+	// the oldest messages are evicted
+	store := NewRedisMessageStore(conn, &config.CacheConfig{MaxMessages: 2, EvictionPolicy: config.CacheEvictOldest})
+	for i := 0; i < 3; i++ {
+		message.Payload = fmt.Sprint(i)
+		evicted, err := store.Append(ctx, "hello", message, time.Minute)
+		if err != nil {
+			t.Fatalf("append error: %v", err)
+		}
+		if expected := i / 2; evicted != expected {
+			t.Errorf("evicted error, expected: %v, actual: %v", expected, evicted)
+		}
+	}
+	if messages, _ := store.Drain(ctx, "hello"); len(messages) != 2 || messages[0].Payload != "1" {
+		t.Errorf("drain error, actual: %v", messages)
+	}
+
+	// the expired messages are removed before evicting any
+	expired := message
+	expired.ExpireAt = time.Now().Add(-time.Second).UnixMilli()
+	store.Append(ctx, "hello", expired, time.Minute)
+	store.Append(ctx, "hello", message, time.Minute)
+	if evicted, _ := store.Append(ctx, "hello", message, time.Minute); evicted != 0 {
+		t.Errorf("evicted error, expected: %v, actual: %v", 0, evicted)
+	}
+	store.Drain(ctx, "hello")
+
+	// the newest message is rejected
+	store = NewRedisMessageStore(conn, &config.CacheConfig{MaxBytes: len(size), EvictionPolicy: config.CacheRejectNewest})
+	if _, err := store.Append(ctx, "hello", message, time.Minute); err != nil {
+		t.Fatalf("append error: %v", err)
+	}
+	if _, err := store.Append(ctx, "hello", message, time.Minute); err != errCacheQuotaExceeded {
+		t.Errorf("append error, expected: %v, actual: %v", errCacheQuotaExceeded, err)
+	}
+	store.Drain(ctx, "hello")
+
+	// the message larger than the quota is never cached
+	store = NewRedisMessageStore(conn, &config.CacheConfig{MaxBytes: len(size) - 1, EvictionPolicy: config.CacheEvictOldest})
+	if _, err := store.Append(ctx, "hello", message, time.Minute); err != errCacheQuotaExceeded {
+		t.Errorf("append error, expected: %v, actual: %v", errCacheQuotaExceeded, err)
+	}
+}
+
+func TestRedisMessageStoreBudget(t *testing.T) {
+	_, conn := newTestRedis(t)
+	ctx := context.TODO()
+	message := SocketMessage{Topic: "hello", Type: Pub, Payload: "1", ExpireAt: time.Now().Add(time.Minute).UnixMilli()}
+	size, _ := message.MarshalBinary()
+
+	store := NewRedisMessageStore(conn, &config.CacheConfig{MemoryBudget: int64(len(size)) - 1, EvictionPolicy: config.CacheEvictOldest})
+	rs := store.(*redisMessageStore)
+	resample := func() { rs.cachedBytesAt = time.Time{} }
+
+	// the budget is shared by the topics
+	if _, err := store.Append(ctx, "hello", message, time.Minute); err != nil {
+		t.Fatalf("append error: %v", err)
+	}
+	resample()
+	if _, err := store.Append(ctx, "world", message, time.Minute); err != errCacheBudgetExceeded {
+		t.Errorf("append error, expected: %v, actual: %v", errCacheBudgetExceeded, err)
+	}
+
+	// and released once the messages are drained
+	store.Drain(ctx, "hello")
+	resample()
+	if _, err := store.Append(ctx, "world", message, time.Minute); err != nil {
+		t.Errorf("append error: %v", err)
+	}
+	store.Delete(ctx, "world")
+	resample()
+	if cachedBytes, _ := rs.sampleCachedBytes(ctx); cachedBytes != 0 {
+		t.Errorf("cached bytes error, expected: %v, actual: %v", 0, cachedBytes)
+	}
+
+	// the expired messages no longer count, and are forgotten
+	conn.HSet(ctx, cachedBytesKey, fmt.Sprint(expiryMinute(time.Now().Add(-time.Minute).UnixMilli())), 1000)
+	if cachedBytes, _ := rs.sampleCachedBytes(ctx); cachedBytes != 0 {
+		t.Errorf("cached bytes error, expected: %v, actual: %v", 0, cachedBytes)
+	}
+	if length := conn.HLen(ctx, cachedBytesKey).Val(); length != 1 {
+		t.Errorf("length error, expected: %v, actual: %v", 1, length)
+	}
+}
+
+// newTestShardedBroker creates the sharded broker of a redis "cluster" served by a single miniredis node
+func newTestShardedBroker(t *testing.T) (*redisShardedBroker, *redis.ClusterClient) {
+	server := miniredis.RunT(t)
+	conn := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{server.Addr()}})
+	t.Cleanup(func() { conn.Close() })
+	return NewRedisShardedBroker(conn).(*redisShardedBroker), conn
+}
+
+func TestShardedBrokerDropsMovedShard(t *testing.T) {
+	broker, conn := newTestShardedBroker(t)
+	ctx := context.TODO()
+	if err := broker.Ping(ctx); err != nil {
+		t.Fatalf("ping error: %v", err)
+	}
+
+	// the shard was subscribed on a master which has failed over
+	broker.Lock()
+	broker.shards[0] = &pubSubShard{subConn: conn.SSubscribe(ctx), addr: "10.0.0.1:6379"}
+	broker.receivers.Add(1)
+	go broker.receive(broker.shards[0].subConn)
+	broker.Unlock()
+
+	if err := broker.Ping(ctx); err == nil {
+		t.Errorf("ping should fail with the shard moved")
+	}
+	if len(broker.shards) != 0 {
+		t.Errorf("moved shard should be dropped, shards: %v", len(broker.shards))
+	}
+	// the broker recovers, the channels are subscribed on the new master from now on
+	if err := broker.Ping(ctx); err != nil {
+		t.Errorf("ping error: %v", err)
+	}
+}
+
+func TestShardedBrokerCloseMessages(t *testing.T) {
+	broker, conn := newTestShardedBroker(t)
+	ctx := context.TODO()
+
+	broker.Lock()
+	broker.shards[0] = &pubSubShard{subConn: conn.SSubscribe(ctx)}
+	broker.receivers.Add(1)
+	go broker.receive(broker.shards[0].subConn)
+	broker.Unlock()
+
+	broker.Close()
+	select {
+	case _, ok := <-broker.Messages():
+		if ok {
+			t.Errorf("no message should be received")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("messages should be closed")
+	}
+	if err := broker.Subscribe(ctx, messageChanKey("hello")); err != errBrokerClosed {
+		t.Errorf("subscribe error, expected: %v, actual: %v", errBrokerClosed, err)
+	}
+}
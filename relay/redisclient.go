@@ -0,0 +1,90 @@
+package relay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/RabbyHub/derelay/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// newRedisClient creates the redis client according to the deployment mode
+func newRedisClient(conf *config.RedisConfig) (redis.UniversalClient, error) {
+	opts := &redis.UniversalOptions{
+		Username: conf.Username,
+		Password: conf.Password,
+		DB:       conf.DB,
+
+		MasterName:       conf.MasterName,
+		SentinelUsername: conf.SentinelUsername,
+		SentinelPassword: conf.SentinelPassword,
+
+		PoolSize:     conf.PoolSize,
+		MinIdleConns: conf.MinIdleConns,
+		DialTimeout:  time.Duration(conf.DialTimeout) * time.Second,
+		ReadTimeout:  time.Duration(conf.ReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(conf.WriteTimeout) * time.Second,
+		PoolTimeout:  time.Duration(conf.PoolTimeout) * time.Second,
+	}
+
+	if conf.TLS.Enable {
+		tlsConfig, err := newRedisTLSConfig(&conf.TLS)
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = tlsConfig
+	}
+
+	switch conf.Mode {
+	case config.RedisModeStandalone:
+		opts.Addrs = []string{conf.ServerAddr}
+		return redis.NewClient(opts.Simple()), nil
+	case config.RedisModeSentinel:
+		if conf.MasterName == "" || len(conf.SentinelAddrs) == 0 {
+			return nil, fmt.Errorf("master_name and sentinel_addrs are required in sentinel mode")
+		}
+		opts.Addrs = conf.SentinelAddrs
+		return redis.NewFailoverClient(opts.Failover()), nil
+	case config.RedisModeCluster:
+		if len(conf.ClusterAddrs) == 0 {
+			return nil, fmt.Errorf("cluster_addrs is required in cluster mode")
+		}
+		opts.Addrs = conf.ClusterAddrs
+		return redis.NewClusterClient(opts.Cluster()), nil
+	default:
+		return nil, fmt.Errorf("unknown redis mode: %v", conf.Mode)
+	}
+}
+
+func newRedisTLSConfig(conf *config.RedisTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+	}
+
+	if conf.CAFile != "" {
+		ca, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read redis CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in redis CA file %v", conf.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load redis client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,151 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/RabbyHub/derelay/log"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	// the consumer group shared by all of the relay nodes
+	streamGroup = "derelay"
+	// all of the subscribers share one consumer, so that the entries a broken connection hasn't acknowledged
+	// can be taken over by the next subscriber connection, no matter which relay node it connects to
+	streamConsumer = "subscribers"
+	// the field of the stream entry holding the message
+	streamMessageField = "message"
+	// number of entries read at a time
+	streamReadCount = 100
+)
+
+// redisMessageStream keeps the messages in per-topic redis streams(redis 6.2+), the entries are deleted
+// once acknowledged, or trimmed once they're older than `ttl`, and the stream expires if the topic is idle for `ttl`
+type redisMessageStream struct {
+	conn redis.UniversalClient
+	ttl  time.Duration
+}
+
+func NewRedisMessageStream(conn redis.UniversalClient, ttl time.Duration) MessageStream {
+	return &redisMessageStream{conn: conn, ttl: ttl}
+}
+
+func (rs *redisMessageStream) Add(ctx context.Context, topic string, message SocketMessage) error {
+	key := messageStreamKey(topic)
+	minID := fmt.Sprintf("%d-0", time.Now().Add(-rs.ttl).UnixMilli())
+
+	cmds, _ := rs.conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		// the group reads from the very beginning, so the entries added before any subscriber comes are read too
+		pipe.XGroupCreateMkStream(ctx, key, streamGroup, "0")
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: key,
+			MinID:  minID,
+			Approx: true,
+			Values: []interface{}{streamMessageField, message},
+		})
+		pipe.Expire(ctx, key, rs.ttl)
+		return nil
+	})
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil && !isRedisError(err, "BUSYGROUP") {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rs *redisMessageStream) Read(ctx context.Context, topic string, pending bool) ([]SocketMessage, error) {
+	key := messageStreamKey(topic)
+	start := ">"
+	if pending {
+		start = "0"
+	}
+
+	messages := []SocketMessage{}
+	for {
+		streams, err := rs.conn.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    streamGroup,
+			Consumer: streamConsumer,
+			Streams:  []string{key, start},
+			Count:    streamReadCount,
+			Block:    -1, // never block
+		}).Result()
+		if errors.Is(err, redis.Nil) || isRedisError(err, "NOGROUP") {
+			// nothing has been published to the topic
+			return messages, nil
+		}
+		if err != nil {
+			return messages, err
+		}
+
+		now := time.Now()
+		entries := streams[0].Messages
+		for _, entry := range entries {
+			message, err := decodeStreamEntry(entry)
+			if err != nil {
+				// the entry will never be delivered, don't let it be read again
+				log.Warn("[stream] drop malformed entry", zap.String("topic", topic), zap.String("id", entry.ID), zap.Error(err))
+				rs.Ack(ctx, topic, entry.ID)
+				continue
+			}
+			if message.expired(now) {
+				rs.Ack(ctx, topic, entry.ID)
+				continue
+			}
+			messages = append(messages, message)
+		}
+		if len(entries) < streamReadCount {
+			return messages, nil
+		}
+		if pending {
+			// the pending entries are read by id, continue after the last one
+			start = entries[len(entries)-1].ID
+		}
+	}
+}
+
+// Ack acknowledges the entries and deletes them, so the delivered messages don't take up redis
+// until they're trimmed
+func (rs *redisMessageStream) Ack(ctx context.Context, topic string, ids ...string) error {
+	key := messageStreamKey(topic)
+	cmds, _ := rs.conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, key, streamGroup, ids...)
+		pipe.XDel(ctx, key, ids...)
+		return nil
+	})
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rs *redisMessageStream) Delete(ctx context.Context, topic string) error {
+	return rs.conn.Del(ctx, messageStreamKey(topic)).Err()
+}
+
+// decodeStreamEntry decodes the message of the stream entry, the pending entries already trimmed have no values
+func decodeStreamEntry(entry redis.XMessage) (SocketMessage, error) {
+	message := SocketMessage{}
+	value, ok := entry.Values[streamMessageField].(string)
+	if !ok {
+		return message, fmt.Errorf("no message in entry")
+	}
+	if err := json.Unmarshal([]byte(value), &message); err != nil {
+		return message, err
+	}
+	message.streamID = entry.ID
+	return message, nil
+}
+
+// isRedisError checks whether the error is a redis error reply with the prefix, e.g. "BUSYGROUP"
+func isRedisError(err error, prefix string) bool {
+	return err != nil && strings.HasPrefix(err.Error(), prefix)
+}
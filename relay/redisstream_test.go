@@ -0,0 +1,123 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestDecodeStreamEntry(t *testing.T) {
+	payload, _ := SocketMessage{Topic: "hello", Type: Pub, Payload: "world"}.MarshalBinary()
+	message, err := decodeStreamEntry(redis.XMessage{ID: "1-0", Values: map[string]interface{}{streamMessageField: string(payload)}})
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if message.Payload != "world" || message.streamID != "1-0" {
+		t.Errorf("decode error, actual: %+v", message)
+	}
+
+	// the pending entries trimmed from the stream have no values
+	if _, err := decodeStreamEntry(redis.XMessage{ID: "2-0"}); err == nil {
+		t.Errorf("entry without message should fail")
+	}
+}
+
+// streamPayloads returns the payloads of the messages read from the stream, and their entry ids
+func streamPayloads(messages []SocketMessage) ([]string, []string) {
+	payloads, ids := []string{}, []string{}
+	for _, message := range messages {
+		payloads = append(payloads, message.Payload)
+		ids = append(ids, message.streamID)
+	}
+	return payloads, ids
+}
+
+func TestRedisStreamReadAndAck(t *testing.T) {
+	_, conn := newTestRedis(t)
+	stream := NewRedisMessageStream(conn, time.Hour)
+	ctx := context.TODO()
+
+	// nothing has been added, the group doesn't exist yet
+	if messages, err := stream.Read(ctx, "hello", false); len(messages) != 0 || err != nil {
+		t.Errorf("read without group error, messages: %v, err: %v", messages, err)
+	}
+
+	// the group is created by the first one, and exists for the second one
+	for i := 0; i < 2; i++ {
+		if err := stream.Add(ctx, "hello", SocketMessage{Topic: "hello", Type: Pub, Payload: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("add error: %v", err)
+		}
+	}
+	messages, err := stream.Read(ctx, "hello", false)
+	if payloads, _ := streamPayloads(messages); err != nil || fmt.Sprint(payloads) != "[0 1]" {
+		t.Errorf("read error, expected: %v, actual: %v, err: %v", "[0 1]", payloads, err)
+	}
+
+	// the entries read are pending until acknowledged, while the new ones are read only once
+	stream.Add(ctx, "hello", SocketMessage{Topic: "hello", Type: Pub, Payload: "2"})
+	messages, _ = stream.Read(ctx, "hello", true)
+	payloads, ids := streamPayloads(messages)
+	if fmt.Sprint(payloads) != "[0 1]" {
+		t.Errorf("read pending error, expected: %v, actual: %v", "[0 1]", payloads)
+	}
+	if messages, _ = stream.Read(ctx, "hello", false); len(messages) != 1 || messages[0].Payload != "2" {
+		t.Errorf("read new error, expected: %v, actual: %v", "[2]", messages)
+	}
+	if messages, _ = stream.Read(ctx, "hello", false); len(messages) != 0 {
+		t.Errorf("new entries should be read only once, actual: %v", messages)
+	}
+
+	if err := stream.Ack(ctx, "hello", ids...); err != nil {
+		t.Fatalf("ack error: %v", err)
+	}
+	// the acknowledged entries are deleted
+	if length := conn.XLen(ctx, messageStreamKey("hello")).Val(); length != 1 {
+		t.Errorf("length error, expected: %v, actual: %v", 1, length)
+	}
+	messages, _ = stream.Read(ctx, "hello", true)
+	if payloads, _ := streamPayloads(messages); fmt.Sprint(payloads) != "[2]" {
+		t.Errorf("read pending after ack error, expected: %v, actual: %v", "[2]", payloads)
+	}
+
+	stream.Delete(ctx, "hello")
+	if messages, err := stream.Read(ctx, "hello", true); len(messages) != 0 || err != nil {
+		t.Errorf("read deleted stream error, messages: %v, err: %v", messages, err)
+	}
+}
+
+func TestRedisStreamSkipsExpired(t *testing.T) {
+	_, conn := newTestRedis(t)
+	stream := NewRedisMessageStream(conn, time.Hour)
+	ctx := context.TODO()
+
+	stream.Add(ctx, "hello", SocketMessage{Topic: "hello", Type: Pub, Payload: "0", ExpireAt: time.Now().Add(-time.Second).UnixMilli()})
+	stream.Add(ctx, "hello", SocketMessage{Topic: "hello", Type: Pub, Payload: "1"})
+	if messages, _ := stream.Read(ctx, "hello", false); len(messages) != 1 || messages[0].Payload != "1" {
+		t.Errorf("read error, expected: %v, actual: %v", "[1]", messages)
+	}
+	// the expired entry is acknowledged right away
+	if messages, _ := stream.Read(ctx, "hello", true); len(messages) != 1 || messages[0].Payload != "1" {
+		t.Errorf("read pending error, expected: %v, actual: %v", "[1]", messages)
+	}
+}
+
+func TestRedisStreamTrim(t *testing.T) {
+	_, conn := newTestRedis(t)
+	stream := NewRedisMessageStream(conn, time.Second)
+	ctx := context.TODO()
+
+	stream.Add(ctx, "hello", SocketMessage{Topic: "hello", Type: Pub, Payload: "0"})
+	time.Sleep(1100 * time.Millisecond)
+	stream.Add(ctx, "hello", SocketMessage{Topic: "hello", Type: Pub, Payload: "1"})
+
+	// the entries older than the ttl are trimmed by the next one
+	if length := conn.XLen(ctx, messageStreamKey("hello")).Val(); length != 1 {
+		t.Errorf("length error, expected: %v, actual: %v", 1, length)
+	}
+	if messages, _ := stream.Read(ctx, "hello", false); len(messages) != 1 || messages[0].Payload != "1" {
+		t.Errorf("read error, expected: %v, actual: %v", "[1]", messages)
+	}
+}
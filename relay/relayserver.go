@@ -2,6 +2,7 @@ package relay
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -10,8 +11,23 @@ import (
 	"github.com/RabbyHub/derelay/config"
 	"github.com/RabbyHub/derelay/log"
 	"github.com/gorilla/mux"
+	"go.uber.org/zap"
 )
 
+// Version of the relay server, overwritten at build time by
+// `-ldflags "-X github.com/RabbyHub/derelay/relay.Version=<version>"`
+var Version = "dev"
+
+// relayInfo is responded by `/info` like the v1 bridge does
+type relayInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Version     string `json:"version"`
+}
+
+// the timeout of the health check
+const healthCheckTimeout = 3 * time.Second
+
 type relayServer struct {
 	httpServer *http.Server
 	wsServer   *WsServer
@@ -25,6 +41,75 @@ func NewRelayServer(config *config.RelayConfig, wsServer *WsServer) *relayServer
 		w.Write([]byte("pong"))
 	})
 
+	r.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("Hello World, this is Derelay %v", Version)))
+	})
+
+	r.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(relayInfo{
+			Name:        "derelay",
+			Description: "WalletConnect Relay Server",
+			Version:     Version,
+		})
+	})
+
+	// health check, checks the broker and the websocket server main loop right away
+	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+		defer cancel()
+		if err := wsServer.Health(ctx); err != nil {
+			log.Warn("health check fail", zap.Error(err))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+
+	// readiness probe, fails when the broker is unreachable or the relay is shutting down
+	r.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if !wsServer.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("not ready"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ready"))
+	})
+
+	// register the push notification webhook of the topic, like the v1 bridge does
+	r.HandleFunc("/subscribe", func(w http.ResponseWriter, r *http.Request) {
+		registration := WebhookRegistration{}
+		if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+			http.Error(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+		if err := registration.validate(wsServer.config.TopicFormat, wsServer.webhookConfig.AllowedHosts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := wsServer.RegisterWebhook(r.Context(), registration)
+		if errors.Is(err, errWebhookDisabled) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errWebhookTaken) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Warn("[webhook] register webhook fail", zap.String("topic", registration.Topic), zap.Error(err))
+			http.Error(w, "register webhook failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"success":true}`))
+	}).Methods(http.MethodPost)
+
 	// handle websocket connection
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		wsServer.NewClientConn(w, r)
@@ -54,11 +139,11 @@ func (rs *relayServer) Run() {
 	}
 }
 
-// Shutdown Gracefully shutdown the relay server
-func (rs *relayServer) Shutdown() {
-	err := rs.httpServer.Shutdown(context.TODO())
+// Shutdown Gracefully shutdown the relay server, the websocket connections are drained before `ctx` is done
+func (rs *relayServer) Shutdown(ctx context.Context) {
+	err := rs.httpServer.Shutdown(ctx)
 	if err != nil {
 		fmt.Println(err)
 	}
-	rs.wsServer.Shutdown()
+	rs.wsServer.Shutdown(ctx)
 }
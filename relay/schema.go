@@ -4,21 +4,40 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"hash/fnv"
 	"strings"
 	"sync"
-
-	"go.uber.org/zap/zapcore"
+	"time"
 )
 
 type MessageType string
 
 const (
-	Pub MessageType = "pub"
-	Sub MessageType = "sub"
-	Ack MessageType = "ack"
+	Pub   MessageType = "pub"
+	Sub   MessageType = "sub"
+	Unsub MessageType = "unsub"
+	Ack   MessageType = "ack"
 
 	Ping MessageType = "ping"
 	Pong MessageType = "pong"
+
+	// Rabby extension, tells the client why its message is rejected
+	Error MessageType = "error"
+)
+
+// ErrorCode is the `code` of the "error" messages
+type ErrorCode int
+
+const (
+	ErrorCacheFull   ErrorCode = 1001 // the message can't be cached for the subscribers offline
+	ErrorRateLimited ErrorCode = 1002 // the client sends messages too fast
+	ErrorTooLarge    ErrorCode = 1003 // the payload or the topic of the message is too large
+	ErrorMalformed   ErrorCode = 1004 // the message can't be parsed
+	ErrorUnsupported ErrorCode = 1005 // the type of the message isn't supported
+	ErrorPublish     ErrorCode = 1006 // the message can't be relayed, e.g. the broker is unreachable
+	ErrorSubscribe   ErrorCode = 1007 // the topic can't be subscribed, e.g. the broker is unreachable
+	ErrorTopic       ErrorCode = 1008 // the topic is empty or malformed
+	ErrorTopicFull   ErrorCode = 1009 // the topic has too many subscribers
 )
 
 // websocket message
@@ -30,7 +49,39 @@ type SocketMessage struct {
 	Phase   string      `json:"phase"`
 	Silent  bool        `json:"silent"`
 
-	client *client `json:"-"`
+	// the time the message is cached for if the subscribers are offline, clamped by the relay
+	TTL      int   `json:"ttl,omitempty"`      // in seconds
+	ExpireAt int64 `json:"expireAt,omitempty"` // unix time in milliseconds, set by the relay
+
+	// Rabby extension, identifies a "pub" message so that the publisher can tell which message an "ack" confirms
+	ID string `json:"id,omitempty"`
+
+	// Rabby extension, the fields of the "error" messages
+	Code   ErrorCode `json:"code,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+
+	// v2 only fields
+	Tag         int   `json:"tag,omitempty"`
+	PublishedAt int64 `json:"publishedAt,omitempty"` // in milliseconds
+
+	client   *client          `json:"-"`
+	streamID string           `json:"-"` // the id of the stream entry the message is read from, stream delivery only
+	recache  bool             `json:"-"` // relayed from the message channel or the cache, cached again if it can't be written
+	call     *rpcCall         `json:"-"` // the json-rpc request this message is translated from, v2 only
+	reply    *JsonRpcResponse `json:"-"` // the json-rpc response to be written as is, v2 only
+}
+
+// expired checks whether the message has expired at `now`
+func (sm SocketMessage) expired(now time.Time) bool {
+	return sm.ExpireAt > 0 && sm.ExpireAt <= now.UnixMilli()
+}
+
+// topics returns the topics the message operates on
+func (sm SocketMessage) topics() []string {
+	if sm.call != nil {
+		return sm.call.topics
+	}
+	return []string{sm.Topic}
 }
 
 func (sm SocketMessage) MarshalBinary() ([]byte, error) {
@@ -56,10 +107,21 @@ const (
 	SessionResumed   PhaseType = "sessionResumed"
 )
 
-// redis key prefix
+// redis key prefix, also used as the channel and cache keys by other backends
 const (
 	// redis message cache
 	cachedMessagePrefix = "wc:relay:cache:pendingMessages:"
+	// redis hash counting the bytes of the cached messages by the minute they expire
+	cachedBytesKey = "wc:relay:cache:bytes"
+
+	// redis message streams
+	messageStreamPrefix = "wc:relay:stream:messages:"
+
+	// redis push notification webhooks
+	webhookPrefix = "wc:relay:webhook:"
+
+	// redis sorted sets of the subscribers of the topics, scored by when they expire
+	subscribersPrefix = "wc:relay:subscribers:"
 
 	// redis message channels
 	messageChan    = "wc:relay:chan:messages:"
@@ -74,7 +136,15 @@ func dappNotifyChanKey(topic string) string {
 	return dappNotifyChan + topic
 }
 
-// fromDappNotifyChan checks whether the redis notify message is from the notfyDapp channel
+// channelTopic returns the topic of the channel
+func channelTopic(channel string) string {
+	if fromDappNotifyChan(channel) {
+		return strings.TrimPrefix(channel, dappNotifyChan)
+	}
+	return strings.TrimPrefix(channel, messageChan)
+}
+
+// fromDappNotifyChan checks whether the broker message is from the notfyDapp channel
 func fromDappNotifyChan(channel string) bool {
 	return strings.HasPrefix(channel, dappNotifyChan)
 }
@@ -83,107 +153,188 @@ func cachedMessageKey(topic string) string {
 	return cachedMessagePrefix + topic
 }
 
-// TopicClientSet stores topic -> clients relationship
+func messageStreamKey(topic string) string {
+	return messageStreamPrefix + topic
+}
+
+func webhookKey(topic string) string {
+	return webhookPrefix + topic
+}
+
+func subscribersKey(topic string) string {
+	return subscribersPrefix + topic
+}
+
+// number of the lock stripes of TopicClientSet
+const topicStripes = 64
+
+// hashString hashes the string for sharding, e.g. picking the lock stripe or the event loop
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+type topicStripe struct {
+	sync.RWMutex
+	data map[string]map[*client]struct{} // topic -> clients
+}
+
+type clientStripe struct {
+	sync.RWMutex
+	data map[*client]map[string]struct{} // client -> topics
+}
+
+// TopicClientSet stores topic -> clients relationship, the topics are spread over the lock stripes so that
+// different topics rarely contend, and the client -> topics reverse index makes the lookups by client cheap
+//
+// NOTE to avoid deadlocks, the topic stripe is always locked before the client stripe
 type TopicClientSet struct {
-	*sync.RWMutex
-	Data map[string]map[*client]struct{}
+	topics  [topicStripes]topicStripe
+	clients [topicStripes]clientStripe
 }
 
 func NewTopicClientSet() *TopicClientSet {
-	return &TopicClientSet{
-		RWMutex: &sync.RWMutex{},
-		Data:    map[string]map[*client]struct{}{},
+	ts := &TopicClientSet{}
+	for i := range ts.topics {
+		ts.topics[i].data = map[string]map[*client]struct{}{}
+		ts.clients[i].data = map[*client]map[string]struct{}{}
 	}
+	return ts
+}
+
+func (ts *TopicClientSet) topicStripe(topic string) *topicStripe {
+	return &ts.topics[hashString(topic)%topicStripes]
+}
+
+func (ts *TopicClientSet) clientStripe(c *client) *clientStripe {
+	return &ts.clients[hashString(c.id)%topicStripes]
 }
 
+// Get returns a copy of the clients of the topic
 func (ts *TopicClientSet) Get(topic string) map[*client]struct{} {
-	ts.RLock()
-	defer ts.RUnlock()
-	return ts.Data[topic]
+	stripe := ts.topicStripe(topic)
+	stripe.RLock()
+	defer stripe.RUnlock()
+	clients := make(map[*client]struct{}, len(stripe.data[topic]))
+	for c := range stripe.data[topic] {
+		clients[c] = struct{}{}
+	}
+	return clients
+}
+
+// Topics returns the topics having clients
+func (ts *TopicClientSet) Topics() []string {
+	topics := []string{}
+	for i := range ts.topics {
+		stripe := &ts.topics[i]
+		stripe.RLock()
+		for topic := range stripe.data {
+			topics = append(topics, topic)
+		}
+		stripe.RUnlock()
+	}
+	return topics
 }
 
 func (ts *TopicClientSet) Set(topic string, c *client) {
-	ts.Lock()
-	defer ts.Unlock()
-	if _, ok := ts.Data[topic]; !ok {
-		ts.Data[topic] = make(map[*client]struct{})
+	stripe := ts.topicStripe(topic)
+	stripe.Lock()
+	defer stripe.Unlock()
+	if _, ok := stripe.data[topic]; !ok {
+		stripe.data[topic] = make(map[*client]struct{})
 	}
+	stripe.data[topic][c] = struct{}{}
 
-	ts.Data[topic][c] = struct{}{}
+	cstripe := ts.clientStripe(c)
+	cstripe.Lock()
+	defer cstripe.Unlock()
+	if _, ok := cstripe.data[c]; !ok {
+		cstripe.data[c] = make(map[string]struct{})
+	}
+	cstripe.data[c][topic] = struct{}{}
 }
 
 // GetTopicsByClient returns the topics associated with the specified client,
 // meanwhile, remove the client from these topics if `clear` is true
 // returns the topics the client has associated with
 func (ts *TopicClientSet) GetTopicsByClient(c *client, clear bool) []string {
-	// Write lock in a read func because we may remove the client from the topics
-	ts.Lock()
-	defer ts.Unlock()
-	topics := []string{}
-	for topic, set := range ts.Data {
-		if _, ok := set[c]; ok {
-			topics = append(topics, topic)
-		}
-		if clear {
-			delete(set, c)
+	cstripe := ts.clientStripe(c)
+	cstripe.RLock()
+	topics := make([]string, 0, len(cstripe.data[c]))
+	for topic := range cstripe.data[c] {
+		topics = append(topics, topic)
+	}
+	cstripe.RUnlock()
+
+	if clear {
+		for _, topic := range topics {
+			ts.Remove(topic, c)
 		}
 	}
 	return topics
 }
 
+// Unset removes the client from the topic, the topic is kept even if it has no more clients
 func (ts *TopicClientSet) Unset(topic string, c *client) {
-	ts.Lock()
-	defer ts.Unlock()
-	delete(ts.Data[topic], c)
-}
-
-func (ts *TopicClientSet) Len(topic string) int {
-	ts.RLock()
-	defer ts.RUnlock()
-	return len(ts.Data[topic])
+	stripe := ts.topicStripe(topic)
+	stripe.Lock()
+	defer stripe.Unlock()
+	delete(stripe.data[topic], c)
+	ts.unindex(topic, c)
 }
 
-func (ts *TopicClientSet) Clear(topic string) {
-	ts.Lock()
-	defer ts.Unlock()
-	delete(ts.Data, topic)
+// Remove removes the client from the topic, and clears the topic if it has no more clients,
+// returns whether the topic has been cleared
+func (ts *TopicClientSet) Remove(topic string, c *client) bool {
+	stripe := ts.topicStripe(topic)
+	stripe.Lock()
+	defer stripe.Unlock()
+	delete(stripe.data[topic], c)
+	ts.unindex(topic, c)
+	if len(stripe.data[topic]) > 0 {
+		return false
+	}
+	delete(stripe.data, topic)
+	return true
 }
 
-type TopicSet struct {
-	*sync.RWMutex
-	Data map[string]struct{}
+// Has checks whether the client is associated with the topic
+func (ts *TopicClientSet) Has(topic string, c *client) bool {
+	stripe := ts.topicStripe(topic)
+	stripe.RLock()
+	defer stripe.RUnlock()
+	_, ok := stripe.data[topic][c]
+	return ok
 }
 
-func NewTopicSet() *TopicSet {
-	return &TopicSet{
-		RWMutex: &sync.RWMutex{},
-		Data:    map[string]struct{}{},
-	}
+func (ts *TopicClientSet) Len(topic string) int {
+	stripe := ts.topicStripe(topic)
+	stripe.RLock()
+	defer stripe.RUnlock()
+	return len(stripe.data[topic])
 }
 
-func (tm TopicSet) Get() map[string]struct{} {
-	tm.Lock()
-	defer tm.Unlock()
-	newmap := make(map[string]struct{})
-	for key, value := range tm.Data {
-		newmap[key] = value
+// Clear removes the topic along with all of its clients
+func (ts *TopicClientSet) Clear(topic string) {
+	stripe := ts.topicStripe(topic)
+	stripe.Lock()
+	defer stripe.Unlock()
+	for c := range stripe.data[topic] {
+		ts.unindex(topic, c)
 	}
-	return newmap
-}
-
-func (tm TopicSet) Set(topic string) {
-	tm.Lock()
-	defer tm.Unlock()
-	tm.Data[topic] = struct{}{}
+	delete(stripe.data, topic)
 }
 
-func (tm TopicSet) MarshalLogArray(encoder zapcore.ArrayEncoder) error {
-	tm.Lock()
-	defer tm.Unlock()
-	for topic := range tm.Data {
-		encoder.AppendString(topic)
+// unindex removes the topic from the reverse index of the client, the topic stripe must be locked
+func (ts *TopicClientSet) unindex(topic string, c *client) {
+	cstripe := ts.clientStripe(c)
+	cstripe.Lock()
+	defer cstripe.Unlock()
+	delete(cstripe.data[c], topic)
+	if len(cstripe.data[c]) == 0 {
+		delete(cstripe.data, c)
 	}
-	return nil
 }
 
 type ClientUnregisterEvent struct {
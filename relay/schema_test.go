@@ -1,6 +1,11 @@
 package relay
 
-import "testing"
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
 
 func TestTopicSetBasic(t *testing.T) {
 	ts := NewTopicClientSet()
@@ -86,26 +91,121 @@ func TestGetTopicsByClientAndClear(t *testing.T) {
 	}
 }
 
-func TestTopicGet(t *testing.T) {
-	ts := NewTopicSet()
+func TestTopicClientSetRemove(t *testing.T) {
+	ts := NewTopicClientSet()
 
-	ts.Set("hello")
-	ts.Set("hello1")
-	ts.Set("hello2")
+	c1, c2 := &client{id: "1"}, &client{id: "2"}
+	ts.Set("hello", c1)
+	ts.Set("hello", c2)
+	ts.Set("world", c1)
 
-	topics := ts.Get()
-	actualLen := len(topics)
-	expectedLen := 3
-	if actualLen != expectedLen {
-		t.Errorf("length error, expected: %v, actual: %v", expectedLen, actualLen)
+	if ts.Remove("hello", c1) {
+		t.Errorf("topic should not be cleared with clients left")
+	}
+	if topics := ts.GetTopicsByClient(c1, false); len(topics) != 1 || topics[0] != "world" {
+		t.Errorf("topics error, expected: %v, actual: %v", []string{"world"}, topics)
+	}
+	if !ts.Remove("hello", c2) {
+		t.Errorf("topic should be cleared without clients")
+	}
+	if topics := ts.Topics(); len(topics) != 1 || topics[0] != "world" {
+		t.Errorf("topics error, expected: %v, actual: %v", []string{"world"}, topics)
+	}
+
+	ts.Clear("world")
+	if topics := ts.GetTopicsByClient(c1, false); len(topics) != 0 {
+		t.Errorf("length error, expected: %v, actual: %v", 0, len(topics))
+	}
+}
+
+func TestTopicClientSetConcurrency(t *testing.T) {
+	ts := NewTopicClientSet()
+
+	clients := make([]*client, 32)
+	wg := sync.WaitGroup{}
+	for i := range clients {
+		clients[i] = &client{id: fmt.Sprint(i)}
+		wg.Add(1)
+		go func(c *client) {
+			defer wg.Done()
+			// the clients share the topics, the odd ones are removed again
+			for j := 0; j < 1000; j++ {
+				ts.Set(fmt.Sprintf("topic-%v", j), c)
+			}
+			for j := 1; j < 1000; j += 2 {
+				ts.Remove(fmt.Sprintf("topic-%v", j), c)
+			}
+			ts.Get("topic-0")
+			ts.Topics()
+		}(clients[i])
+	}
+	wg.Wait()
+
+	if topics := ts.Topics(); len(topics) != 500 {
+		t.Errorf("length error, expected: %v, actual: %v", 500, len(topics))
 	}
-	if _, ok := topics["hello"]; !ok {
-		t.Errorf("key does not exists")
+	for _, c := range clients {
+		if topics := ts.GetTopicsByClient(c, false); len(topics) != 500 {
+			t.Errorf("length error, expected: %v, actual: %v", 500, len(topics))
+		}
 	}
-	if _, ok := topics["hello1"]; !ok {
-		t.Errorf("key does not exists")
+	if actual := ts.Len("topic-0"); actual != len(clients) {
+		t.Errorf("length error, expected: %v, actual: %v", len(clients), actual)
 	}
-	if _, ok := topics["hello2"]; !ok {
-		t.Errorf("key does not exists")
+	if actual := ts.Len("topic-1"); actual != 0 {
+		t.Errorf("length error, expected: %v, actual: %v", 0, actual)
+	}
+}
+
+// newBenchTopicClientSet creates the set with `n` clients, each of them has two topics
+func newBenchTopicClientSet(n int) (*TopicClientSet, []*client) {
+	ts := NewTopicClientSet()
+	clients := make([]*client, n)
+	for i := range clients {
+		clients[i] = &client{id: fmt.Sprint(i)}
+		ts.Set(fmt.Sprintf("%032x", 2*i), clients[i])
+		ts.Set(fmt.Sprintf("%032x", 2*i+1), clients[i])
+	}
+	return ts, clients
+}
+
+func BenchmarkTopicClientSetSet(b *testing.B) {
+	ts, clients := newBenchTopicClientSet(100000)
+	topics := make([]string, 200000)
+	for i := range topics {
+		topics[i] = fmt.Sprintf("%032x", i)
+	}
+
+	counter := atomic.Int64{}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := int(counter.Add(1))
+			c := clients[i%len(clients)]
+			ts.Set(topics[i%len(topics)], c)
+			ts.Get(topics[(i+1)%len(topics)])
+		}
+	})
+}
+
+func BenchmarkGetTopicsByClient(b *testing.B) {
+	ts, clients := newBenchTopicClientSet(100000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ts.GetTopicsByClient(clients[i%len(clients)], false)
+	}
+}
+
+func BenchmarkTopicClientSetRemove(b *testing.B) {
+	ts, clients := newBenchTopicClientSet(100000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := clients[i%len(clients)]
+		for _, topic := range ts.GetTopicsByClient(c, true) {
+			// put it back for the next round
+			ts.Set(topic, c)
+		}
 	}
 }
@@ -0,0 +1,45 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+// pendingSessions tracks the session requests which haven't been received by any wallet yet,
+// i.e. the QRCodes which haven't been scanned
+type pendingSessions struct {
+	sync.Mutex
+	deadlines map[string]time.Time // topic -> expiry time
+}
+
+func newPendingSessions() *pendingSessions {
+	return &pendingSessions{
+		deadlines: map[string]time.Time{},
+	}
+}
+
+func (ps *pendingSessions) add(topic string, expireAt time.Time) {
+	ps.Lock()
+	defer ps.Unlock()
+	ps.deadlines[topic] = expireAt
+}
+
+func (ps *pendingSessions) remove(topic string) {
+	ps.Lock()
+	defer ps.Unlock()
+	delete(ps.deadlines, topic)
+}
+
+// popExpired removes and returns the sessions expired by `now`
+func (ps *pendingSessions) popExpired(now time.Time) []string {
+	ps.Lock()
+	defer ps.Unlock()
+	topics := []string{}
+	for topic, expireAt := range ps.deadlines {
+		if !now.Before(expireAt) {
+			topics = append(topics, topic)
+			delete(ps.deadlines, topic)
+		}
+	}
+	return topics
+}
@@ -0,0 +1,29 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPendingSessionsExpiry(t *testing.T) {
+	ps := newPendingSessions()
+
+	now := time.Now()
+	ps.add("expired", now.Add(-time.Second))
+	ps.add("pending", now.Add(time.Minute))
+	ps.add("received", now.Add(-time.Second))
+	ps.remove("received")
+
+	topics := ps.popExpired(now)
+	if len(topics) != 1 || topics[0] != "expired" {
+		t.Errorf("expired sessions error, expected: %v, actual: %v", []string{"expired"}, topics)
+	}
+
+	// expired sessions are only reported once
+	if topics := ps.popExpired(now); len(topics) != 0 {
+		t.Errorf("length error, expected: %v, actual: %v", 0, len(topics))
+	}
+	if topics := ps.popExpired(now.Add(time.Hour)); len(topics) != 1 {
+		t.Errorf("length error, expected: %v, actual: %v", 1, len(topics))
+	}
+}
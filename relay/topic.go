@@ -0,0 +1,178 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/RabbyHub/derelay/config"
+	"github.com/RabbyHub/derelay/log"
+	"github.com/RabbyHub/derelay/metrics"
+	"go.uber.org/zap"
+)
+
+var (
+	uuidTopic = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-4[0-9a-fA-F]{3}-[89abAB][0-9a-fA-F]{3}-[0-9a-fA-F]{12}$`)
+	hexTopic  = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+)
+
+// validTopic checks the topic against the format of `WsConfig.TopicFormat`, the empty topic is never valid
+func validTopic(format string, topic string) bool {
+	switch format {
+	case config.TopicFormatUUID:
+		return uuidTopic.MatchString(topic)
+	case config.TopicFormatHex:
+		return hexTopic.MatchString(topic)
+	case config.TopicFormatWalletConnect:
+		return uuidTopic.MatchString(topic) || hexTopic.MatchString(topic)
+	default:
+		return topic != ""
+	}
+}
+
+// validTopics checks the topics of the message, the message with invalid topics is rejected with an error
+func (c *client) validTopics(message SocketMessage) bool {
+	// the ping messages carry no topic
+	if message.Type == Ping {
+		return true
+	}
+	for _, topic := range message.topics() {
+		if validTopic(c.ws.config.TopicFormat, topic) {
+			continue
+		}
+
+		metrics.IncRejectedMessage("topic")
+		log.Warn("reject message with invalid topic", zap.Any("client", c), zap.String("topic", topic))
+		reason := fmt.Sprintf("invalid topic: %q", topic)
+		if message.call != nil {
+			c.send(rpcReply(message.call, nil, &JsonRpcError{Code: JsonRpcInvalidParams, Message: reason}))
+		} else {
+			c.ws.sendError(c, topic, ErrorTopic, reason)
+		}
+		return false
+	}
+	return true
+}
+
+// admitSubscription checks whether the topics of the subscription have room for one more subscriber across
+// the relay nodes, so that a topic can't be hijacked by the subscribers more than expected, e.g. one wallet and
+// its backup. it's called by the read loop of the client before the message is dispatched, so that the topics of
+// a batch subscription are admitted all or none, and the unsubscribed topics are released in order
+func (c *client) admitSubscription(message SocketMessage) bool {
+	store := c.ws.subscriberStore
+	if store == nil {
+		return true
+	}
+
+	switch message.Type {
+	case Sub, IrnSubscribe, IrnBatchSubscribe:
+	case Unsub, IrnUnsubscribe:
+		// the unsupported unsubscription, e.g. `unsub` in the strict mode, keeps the subscription
+		if _, ok := c.ws.handler(message); ok {
+			c.ws.leaveTopics(c.id, message.Topic)
+		}
+		return true
+	default:
+		return true
+	}
+
+	max := c.ws.config.MaxSubscribersPerTopic
+	ttl := time.Duration(c.ws.config.SubscriberTTL) * time.Second
+	joined := []string{}
+	for _, topic := range message.topics() {
+		admitted, rejoined, err := store.Join(context.TODO(), topic, c.id, max, ttl)
+		if err != nil {
+			// don't lock the wallets out of their topics while the store is down
+			metrics.IncBrokerError("join")
+			log.Warn("[broker] join topic fail", zap.Any("client", c), zap.String("topic", topic), zap.Error(err))
+			continue
+		}
+		if admitted {
+			if !rejoined {
+				joined = append(joined, topic)
+			}
+			continue
+		}
+
+		// release the topics joined by this batch subscription
+		c.ws.leaveTopics(c.id, joined...)
+
+		metrics.IncRejectedMessage("topic_full")
+		log.Warn("reject subscription, too many subscribers", zap.Any("client", c), zap.String("topic", topic))
+		reason := fmt.Sprintf("too many subscribers of topic: %q", topic)
+		if message.call != nil {
+			c.send(rpcReply(message.call, nil, &JsonRpcError{Code: JsonRpcLimitExceeded, Message: reason}))
+		} else {
+			c.ws.sendError(c, topic, ErrorTopicFull, reason)
+		}
+		return false
+	}
+	return true
+}
+
+// leaveTopics releases the subscriber's slots of the topics
+func (ws *WsServer) leaveTopics(subscriber string, topics ...string) {
+	if ws.subscriberStore == nil {
+		return
+	}
+	for _, topic := range topics {
+		if err := ws.subscriberStore.Leave(context.TODO(), topic, subscriber); err != nil {
+			metrics.IncBrokerError("leave")
+			log.Warn("[broker] leave topic fail", zap.String("subscriber", subscriber), zap.String("topic", topic), zap.Error(err))
+		}
+	}
+}
+
+// localSubscribers returns the ids of the subscribers on this relay node, keyed by the topics
+func (ws *WsServer) localSubscribers() map[string][]string {
+	subscribers := map[string][]string{}
+	for _, topic := range ws.subscribers.Topics() {
+		for c := range ws.subscribers.Get(topic) {
+			subscribers[topic] = append(subscribers[topic], c.id)
+		}
+	}
+	return subscribers
+}
+
+// leaveAllTopics releases the slots of all of the subscribers on this relay node
+func (ws *WsServer) leaveAllTopics(ctx context.Context) {
+	if ws.subscriberStore == nil {
+		return
+	}
+	for topic, ids := range ws.localSubscribers() {
+		if err := ws.subscriberStore.Leave(ctx, topic, ids...); err != nil {
+			metrics.IncBrokerError("leave")
+			log.Warn("[broker] leave topic fail", zap.String("topic", topic), zap.Error(err))
+		}
+	}
+}
+
+// refreshSubscribers periodically keeps the slots of the subscribers on this relay node,
+// the slots of a crashed relay node are released once they expire
+func (ws *WsServer) refreshSubscribers() {
+	if ws.subscriberStore == nil {
+		return
+	}
+
+	ttl := time.Duration(ws.config.SubscriberTTL) * time.Second
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			subscribers := ws.localSubscribers()
+			if len(subscribers) == 0 {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), ttl/3)
+			if err := ws.subscriberStore.Refresh(ctx, subscribers, ttl); err != nil {
+				metrics.IncBrokerError("refresh")
+				log.Warn("[broker] refresh subscribers fail", zap.Int("topics", len(subscribers)), zap.Error(err))
+			}
+			cancel()
+		case <-ws.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package relay
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RabbyHub/derelay/config"
+)
+
+func TestValidTopic(t *testing.T) {
+	uuid := "70a69a10-d3ca-43e8-a418-f6d6e6470969"
+	hex := strings.Repeat("0a", 32)
+	cases := []struct {
+		format string
+		topic  string
+		valid  bool
+	}{
+		{config.TopicFormatAny, "hello", true},
+		{config.TopicFormatAny, "", false},
+		{config.TopicFormatUUID, uuid, true},
+		{config.TopicFormatUUID, strings.ToUpper(uuid), true},
+		// uuid v1
+		{config.TopicFormatUUID, "70a69a10-d3ca-13e8-a418-f6d6e6470969", false},
+		{config.TopicFormatUUID, hex, false},
+		{config.TopicFormatHex, hex, true},
+		{config.TopicFormatHex, hex[2:], false},
+		{config.TopicFormatHex, uuid, false},
+		{config.TopicFormatWalletConnect, uuid, true},
+		{config.TopicFormatWalletConnect, hex, true},
+		{config.TopicFormatWalletConnect, "hello", false},
+		{config.TopicFormatWalletConnect, "", false},
+	}
+	for _, c := range cases {
+		if actual := validTopic(c.format, c.topic); actual != c.valid {
+			t.Errorf("validate error, format: %v, topic: %q, expected: %v, actual: %v", c.format, c.topic, c.valid, actual)
+		}
+	}
+}
+
+func TestInvalidTopicRejected(t *testing.T) {
+	conf := config.LoadConfig("")
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+	c := newTestClient(ws)
+
+	if !c.validTopics(SocketMessage{Type: Ping}) {
+		t.Errorf("ping without topic should be allowed")
+	}
+	if c.validTopics(SocketMessage{Type: Sub}) {
+		t.Errorf("empty topic should be rejected")
+	}
+	if reply := <-c.sendbuf; reply.Type != Error || reply.Code != ErrorTopic {
+		t.Errorf("topic error should be sent, actual: %+v", reply)
+	}
+}
+
+func TestMaxSubscribersPerTopic(t *testing.T) {
+	conf := config.LoadConfig("")
+	conf.WsServerConfig.MaxSubscribersPerTopic = 2
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+	ws.setupSubscriberLimit(NewMemorySubscriberStore())
+
+	wallets := []*client{newTestClient(ws), newTestClient(ws), newTestClient(ws)}
+	for _, wallet := range wallets[:2] {
+		message := SocketMessage{Topic: "hello", Type: Sub, client: wallet}
+		if !wallet.admitSubscription(message) {
+			t.Errorf("subscription should be admitted")
+		}
+		ws.updateTopics(message)
+	}
+
+	// the existing subscriber can subscribe again
+	if !wallets[0].admitSubscription(SocketMessage{Topic: "hello", Type: Sub, client: wallets[0]}) {
+		t.Errorf("resubscription should be admitted")
+	}
+	if wallets[2].admitSubscription(SocketMessage{Topic: "hello", Type: Sub, client: wallets[2]}) {
+		t.Errorf("subscription should be rejected with the topic full")
+	}
+	if reply := <-wallets[2].sendbuf; reply.Type != Error || reply.Code != ErrorTopicFull || reply.Topic != "hello" {
+		t.Errorf("topic full error should be sent, actual: %+v", reply)
+	}
+	// publishing isn't limited
+	if !wallets[2].admitSubscription(SocketMessage{Topic: "hello", Type: Pub, client: wallets[2]}) {
+		t.Errorf("publishing should be admitted")
+	}
+
+	ws.handleClientDisconnect(wallets[1])
+	// the slot is released asynchronously on disconnecting
+	deadline := time.Now().Add(time.Second)
+	for !wallets[2].admitSubscription(SocketMessage{Topic: "hello", Type: Sub, client: wallets[2]}) {
+		<-wallets[2].sendbuf
+		if time.Now().After(deadline) {
+			t.Fatalf("subscription should be admitted after a subscriber leaves")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// unsubscribing releases the slot at once
+	wallets[2].admitSubscription(SocketMessage{Topic: "hello", Type: Unsub, client: wallets[2]})
+	if !wallets[1].admitSubscription(SocketMessage{Topic: "hello", Type: Sub, client: wallets[1]}) {
+		t.Errorf("subscription should be admitted after a subscriber unsubscribes")
+	}
+}
+
+func TestMaxSubscribersPerTopicAcrossNodes(t *testing.T) {
+	_, conn := newTestRedis(t)
+	conf := config.LoadConfig("")
+	conf.WsServerConfig.MaxSubscribersPerTopic = 1
+	nodes := []*WsServer{}
+	for i := 0; i < 2; i++ {
+		backend := newStubBackend()
+		ws := NewWSServerWithBackend(&conf, backend, backend)
+		ws.setupSubscriberLimit(NewRedisSubscriberStore(conn))
+		nodes = append(nodes, ws)
+	}
+
+	wallet, hijacker := newTestClient(nodes[0]), newTestClient(nodes[1])
+	if !wallet.admitSubscription(SocketMessage{Topic: "hello", Type: Sub, client: wallet}) {
+		t.Errorf("subscription should be admitted")
+	}
+	if hijacker.admitSubscription(SocketMessage{Topic: "hello", Type: Sub, client: hijacker}) {
+		t.Errorf("subscription on another relay node should be rejected with the topic full")
+	}
+}
+
+func TestBatchSubscriptionAdmittedAllOrNone(t *testing.T) {
+	conf := config.LoadConfig("")
+	conf.WsServerConfig.MaxSubscribersPerTopic = 1
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+	ws.setupSubscriberLimit(NewMemorySubscriberStore())
+
+	wallet, another := newTestClient(ws), newTestClient(ws)
+	wallet.protocol, another.protocol = V2, V2
+	if !wallet.admitSubscription(SocketMessage{Topic: "full", Type: Sub, client: wallet}) {
+		t.Errorf("subscription should be admitted")
+	}
+
+	batch := SocketMessage{Type: IrnBatchSubscribe, client: another, call: &rpcCall{id: []byte("1"), topics: []string{"hello", "full"}}}
+	if another.admitSubscription(batch) {
+		t.Errorf("batch subscription should be rejected with a topic full")
+	}
+	if reply := <-another.sendbuf; reply.reply == nil || reply.reply.Error == nil || reply.reply.Error.Code != JsonRpcLimitExceeded {
+		t.Errorf("json-rpc error should be replied, actual: %+v", reply.reply)
+	}
+	// the topics joined by the rejected batch are released
+	if !wallet.admitSubscription(SocketMessage{Topic: "hello", Type: Sub, client: wallet}) {
+		t.Errorf("subscription should be admitted")
+	}
+}
+
+// testSubscriberStore checks the subscribers of the topic "hello" are limited by the store
+func testSubscriberStore(t *testing.T, store SubscriberStore) {
+	ctx := context.TODO()
+	join := func(subscriber string, ttl time.Duration) (bool, bool) {
+		admitted, joined, err := store.Join(ctx, "hello", subscriber, 2, ttl)
+		if err != nil {
+			t.Fatalf("join error: %v", err)
+		}
+		return admitted, joined
+	}
+
+	if admitted, joined := join("a", time.Minute); !admitted || joined {
+		t.Errorf("join error, admitted: %v, joined: %v", admitted, joined)
+	}
+	if admitted, joined := join("b", time.Minute); !admitted || joined {
+		t.Errorf("join error, admitted: %v, joined: %v", admitted, joined)
+	}
+	if admitted, joined := join("a", time.Minute); !admitted || !joined {
+		t.Errorf("join again error, admitted: %v, joined: %v", admitted, joined)
+	}
+	if admitted, _ := join("c", time.Minute); admitted {
+		t.Errorf("join should be rejected with the topic full")
+	}
+
+	store.Leave(ctx, "hello", "b")
+	if admitted, _ := join("c", 50*time.Millisecond); !admitted {
+		t.Errorf("join should be admitted after a subscriber leaves")
+	}
+
+	// the expired subscriber doesn't count unless it's refreshed
+	store.Refresh(ctx, map[string][]string{"hello": {"a"}}, 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	store.Refresh(ctx, map[string][]string{"hello": {"a"}}, time.Minute)
+	if admitted, joined := join("d", time.Minute); !admitted || joined {
+		t.Errorf("join should be admitted after a subscriber expires, admitted: %v, joined: %v", admitted, joined)
+	}
+	if admitted, _ := join("e", time.Minute); admitted {
+		t.Errorf("join should be rejected with the topic full")
+	}
+}
+
+func TestMemorySubscriberStore(t *testing.T) {
+	testSubscriberStore(t, NewMemorySubscriberStore())
+}
+
+func TestRedisSubscriberStore(t *testing.T) {
+	_, conn := newTestRedis(t)
+	testSubscriberStore(t, NewRedisSubscriberStore(conn))
+}
@@ -0,0 +1,233 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/RabbyHub/derelay/config"
+	"github.com/RabbyHub/derelay/log"
+	"github.com/RabbyHub/derelay/metrics"
+	"go.uber.org/zap"
+)
+
+var (
+	errWebhookDisabled = errors.New("push notification webhook is disabled")
+	// the topic has been registered with another push token
+	errWebhookTaken = errors.New("webhook of the topic is registered by another wallet")
+	// the webhook resolves to an internal address
+	errWebhookAddress = errors.New("webhook address not allowed")
+)
+
+// WebhookRegistration is registered by the wallet through `POST /subscribe` like the v1 bridge, the webhook
+// is called when a non-silent message is cached for the topic, i.e. the wallet is sleeping.
+// the push token identifies the registrant, only the same token can register the topic again
+type WebhookRegistration struct {
+	Topic    string `json:"topic"`
+	Webhook  string `json:"webhook"`
+	Bridge   string `json:"bridge,omitempty"`
+	Language string `json:"language,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+// webhookNotification is posted to the webhook
+type webhookNotification struct {
+	Topic    string `json:"topic"`
+	Bridge   string `json:"bridge,omitempty"`
+	Language string `json:"language,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+// validate checks the registration, the webhook must be a http(s) url pointing to one of the allowed hosts
+func (wr WebhookRegistration) validate(topicFormat string, allowedHosts []string) error {
+	if !validTopic(topicFormat, wr.Topic) {
+		return fmt.Errorf("invalid topic: %q", wr.Topic)
+	}
+	if wr.Token == "" {
+		return fmt.Errorf("token is required")
+	}
+	u, err := url.Parse(wr.Webhook)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook: %q", wr.Webhook)
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !publicIP(ip) {
+		return fmt.Errorf("%w: %q", errWebhookAddress, u.Hostname())
+	}
+	if len(allowedHosts) == 0 {
+		return nil
+	}
+	for _, host := range allowedHosts {
+		if u.Hostname() == host {
+			return nil
+		}
+	}
+	return fmt.Errorf("webhook host not allowed: %q", u.Hostname())
+}
+
+// publicIP checks whether the ip is a public one, rather than the loopback, private, link-local or any other
+// address reaching the internal services
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// dialPublic refuses to connect to the non-public addresses, it's checked after the host is resolved,
+// so that an allowed host can't be pointed to the internal services
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("%w: %v", errWebhookAddress, host)
+	}
+	return nil
+}
+
+// webhookDispatcher calls the webhooks in a pool of workers, the failed calls are retried with backoff
+type webhookDispatcher struct {
+	config *config.WebhookConfig
+	client *http.Client
+
+	queue chan *WebhookRegistration
+	quit  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newWebhookDispatcher(conf *config.WebhookConfig) *webhookDispatcher {
+	timeout := time.Duration(conf.Timeout) * time.Second
+	wd := &webhookDispatcher{
+		config: conf,
+		client: &http.Client{
+			Timeout: timeout,
+			// no proxy, so that the addresses dialed are the webhook ones
+			Transport: &http.Transport{
+				DialContext:         (&net.Dialer{Timeout: timeout, Control: dialPublic}).DialContext,
+				TLSHandshakeTimeout: timeout,
+				MaxIdleConnsPerHost: conf.Workers,
+			},
+			// the webhook must not redirect to another host
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		queue: make(chan *WebhookRegistration, conf.QueueSize),
+		quit:  make(chan struct{}),
+	}
+	for i := 0; i < conf.Workers; i++ {
+		wd.wg.Add(1)
+		go wd.work()
+	}
+	return wd
+}
+
+// dispatch queues the webhook call, it never blocks
+func (wd *webhookDispatcher) dispatch(registration *WebhookRegistration) {
+	select {
+	case wd.queue <- registration:
+	default:
+		metrics.IncWebhookCall("dropped")
+		log.Warn("[webhook] queue is full, drop webhook call", zap.String("topic", registration.Topic))
+	}
+}
+
+func (wd *webhookDispatcher) work() {
+	defer wd.wg.Done()
+	for {
+		select {
+		case registration := <-wd.queue:
+			wd.call(registration)
+		case <-wd.quit:
+			return
+		}
+	}
+}
+
+// call posts the notification to the webhook, retries on network errors and server errors
+func (wd *webhookDispatcher) call(registration *WebhookRegistration) {
+	body, _ := json.Marshal(webhookNotification{
+		Topic:    registration.Topic,
+		Bridge:   registration.Bridge,
+		Language: registration.Language,
+		Token:    registration.Token,
+	})
+
+	backoff := time.Duration(wd.config.RetryInterval) * time.Second
+	for attempt := 0; ; attempt++ {
+		retry, err := wd.post(registration.Webhook, body)
+		if err == nil {
+			metrics.IncWebhookCall("success")
+			log.Debug("[webhook] webhook called", zap.String("topic", registration.Topic))
+			return
+		}
+		if !retry || attempt >= wd.config.MaxRetries {
+			metrics.IncWebhookCall("failure")
+			log.Warn("[webhook] call webhook fail", zap.String("topic", registration.Topic), zap.Int("attempts", attempt+1), zap.Error(err))
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-wd.quit:
+			return
+		}
+	}
+}
+
+// post posts the body to the webhook, returns whether it's worth retrying on failure
+func (wd *webhookDispatcher) post(webhook string, body []byte) (bool, error) {
+	resp, err := wd.client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return !errors.Is(err, errWebhookAddress), err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook responds %v", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook responds %v", resp.Status)
+	}
+}
+
+// close stops the workers, the queued calls are abandoned
+func (wd *webhookDispatcher) close() {
+	close(wd.quit)
+	wd.wg.Wait()
+}
+
+// RegisterWebhook registers the push notification webhook of the topic
+func (ws *WsServer) RegisterWebhook(ctx context.Context, registration WebhookRegistration) error {
+	if ws.webhooks == nil {
+		return errWebhookDisabled
+	}
+	ttl := time.Duration(ws.webhookConfig.RegistrationTTL) * time.Second
+	return ws.webhooks.Register(ctx, registration, ttl)
+}
+
+// pushNotify calls the webhook registered for the topic, if there's any
+func (ws *WsServer) pushNotify(topic string) {
+	if ws.webhooks == nil {
+		return
+	}
+	registration, err := ws.webhooks.Get(context.TODO(), topic)
+	if err != nil {
+		log.Warn("[webhook] get webhook fail", zap.String("topic", topic), zap.Error(err))
+		return
+	}
+	if registration == nil {
+		return
+	}
+	ws.dispatcher.dispatch(registration)
+}
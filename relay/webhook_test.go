@@ -0,0 +1,198 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/RabbyHub/derelay/config"
+)
+
+func TestWebhookRegistrationValidate(t *testing.T) {
+	uuid := "70a69a10-d3ca-43e8-a418-f6d6e6470969"
+	cases := []struct {
+		registration WebhookRegistration
+		allowedHosts []string
+		valid        bool
+	}{
+		{WebhookRegistration{Topic: uuid, Webhook: "https://push.example.com/notify", Token: "token"}, nil, true},
+		{WebhookRegistration{Topic: uuid, Webhook: "https://push.example.com/notify", Token: "token"}, []string{"push.example.com"}, true},
+		{WebhookRegistration{Topic: uuid, Webhook: "https://evil.example.com/notify", Token: "token"}, []string{"push.example.com"}, false},
+		{WebhookRegistration{Topic: uuid, Webhook: "ftp://push.example.com/notify", Token: "token"}, nil, false},
+		{WebhookRegistration{Topic: uuid, Webhook: "push.example.com", Token: "token"}, nil, false},
+		{WebhookRegistration{Topic: uuid, Webhook: "https://push.example.com/notify"}, nil, false},
+		{WebhookRegistration{Webhook: "https://push.example.com/notify", Token: "token"}, nil, false},
+		{WebhookRegistration{Topic: "hello", Webhook: "https://push.example.com/notify", Token: "token"}, nil, false},
+		{WebhookRegistration{Topic: uuid, Webhook: "http://127.0.0.1/notify", Token: "token"}, nil, false},
+		{WebhookRegistration{Topic: uuid, Webhook: "http://169.254.169.254/latest", Token: "token"}, nil, false},
+		{WebhookRegistration{Topic: uuid, Webhook: "http://[::1]/notify", Token: "token"}, nil, false},
+	}
+	for _, c := range cases {
+		if err := c.registration.validate(config.TopicFormatWalletConnect, c.allowedHosts); (err == nil) != c.valid {
+			t.Errorf("validate error, registration: %+v, expected valid: %v, actual: %v", c.registration, c.valid, err)
+		}
+	}
+}
+
+// allowLoopback lets the dispatcher call the webhooks served by httptest
+func allowLoopback(dispatcher *webhookDispatcher) {
+	dispatcher.client.Transport = &http.Transport{}
+}
+
+func TestMemoryWebhookStore(t *testing.T) {
+	store := NewMemoryWebhookStore()
+	ctx := context.TODO()
+
+	if registration, err := store.Get(ctx, "hello"); registration != nil || err != nil {
+		t.Errorf("get unregistered error, registration: %v, err: %v", registration, err)
+	}
+
+	store.Register(ctx, WebhookRegistration{Topic: "hello", Webhook: "https://push.example.com/notify", Token: "token"}, time.Hour)
+	if registration, _ := store.Get(ctx, "hello"); registration == nil || registration.Webhook != "https://push.example.com/notify" {
+		t.Errorf("get error, registration: %v", registration)
+	}
+	testWebhookOverwrite(t, store)
+
+	store.Register(ctx, WebhookRegistration{Topic: "expired", Webhook: "https://push.example.com/notify"}, -time.Second)
+	if registration, _ := store.Get(ctx, "expired"); registration != nil {
+		t.Errorf("registration should expire, actual: %v", registration)
+	}
+}
+
+// testWebhookOverwrite checks the topic "hello" registered with "token" can only be registered again with the same token
+func testWebhookOverwrite(t *testing.T, store WebhookStore) {
+	ctx := context.TODO()
+	err := store.Register(ctx, WebhookRegistration{Topic: "hello", Webhook: "https://evil.example.com/notify", Token: "another"}, time.Hour)
+	if err != errWebhookTaken {
+		t.Errorf("register error, expected: %v, actual: %v", errWebhookTaken, err)
+	}
+	if err := store.Register(ctx, WebhookRegistration{Topic: "hello", Webhook: "https://push.example.com/v2", Token: "token"}, time.Hour); err != nil {
+		t.Errorf("register again error: %v", err)
+	}
+	if registration, _ := store.Get(ctx, "hello"); registration == nil || registration.Webhook != "https://push.example.com/v2" {
+		t.Errorf("get error, registration: %v", registration)
+	}
+}
+
+func TestRedisWebhookStore(t *testing.T) {
+	_, conn := newTestRedis(t)
+	store := NewRedisWebhookStore(conn)
+	ctx := context.TODO()
+
+	if registration, err := store.Get(ctx, "hello"); registration != nil || err != nil {
+		t.Errorf("get unregistered error, registration: %v, err: %v", registration, err)
+	}
+	if err := store.Register(ctx, WebhookRegistration{Topic: "hello", Webhook: "https://push.example.com/notify", Token: "token"}, time.Hour); err != nil {
+		t.Fatalf("register error: %v", err)
+	}
+	testWebhookOverwrite(t, store)
+}
+
+func TestWebhookDispatcherRetries(t *testing.T) {
+	calls := atomic.Int32{}
+	received := make(chan webhookNotification, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fails the first call
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		notification := webhookNotification{}
+		json.NewDecoder(r.Body).Decode(&notification)
+		received <- notification
+	}))
+	defer server.Close()
+
+	conf := config.LoadConfig("").WebhookConfig
+	conf.RetryInterval = 0
+	dispatcher := newWebhookDispatcher(&conf)
+	defer dispatcher.close()
+	allowLoopback(dispatcher)
+
+	dispatcher.dispatch(&WebhookRegistration{Topic: "hello", Webhook: server.URL, Token: "token"})
+	select {
+	case notification := <-received:
+		if notification.Topic != "hello" || notification.Token != "token" {
+			t.Errorf("notification error, actual: %+v", notification)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("webhook not called")
+	}
+	if calls.Load() != 2 {
+		t.Errorf("calls error, expected: %v, actual: %v", 2, calls.Load())
+	}
+}
+
+func TestWebhookDispatcherRefusesInternalAddresses(t *testing.T) {
+	calls := atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer server.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(server.URL, http.StatusFound))
+	defer redirect.Close()
+
+	conf := config.LoadConfig("").WebhookConfig
+	dispatcher := newWebhookDispatcher(&conf)
+	defer dispatcher.close()
+
+	// the loopback address is refused once resolved, and not retried
+	if retry, err := dispatcher.post(strings.Replace(server.URL, "127.0.0.1", "localhost", 1), nil); retry || !errors.Is(err, errWebhookAddress) {
+		t.Errorf("post error, retry: %v, err: %v", retry, err)
+	}
+
+	// the redirects aren't followed
+	allowLoopback(dispatcher)
+	if _, err := dispatcher.post(redirect.URL, nil); err == nil {
+		t.Errorf("redirect should fail")
+	}
+	if calls.Load() != 0 {
+		t.Errorf("calls error, expected: %v, actual: %v", 0, calls.Load())
+	}
+}
+
+func TestPushNotifyOnCachedMessage(t *testing.T) {
+	received := make(chan webhookNotification, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notification := webhookNotification{}
+		json.NewDecoder(r.Body).Decode(&notification)
+		received <- notification
+	}))
+	defer server.Close()
+
+	conf := config.LoadConfig("")
+	conf.WebhookConfig.Enable = true
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+	ws.setupWebhooks(NewMemoryWebhookStore())
+	defer ws.dispatcher.close()
+	allowLoopback(ws.dispatcher)
+
+	ws.RegisterWebhook(context.TODO(), WebhookRegistration{Topic: "hello", Webhook: server.URL, Token: "token"})
+
+	dapp := newTestClient(ws)
+	dapp.role = Dapp
+	ws.legacyPubMessage(SocketMessage{Topic: "hello", Type: Pub, Payload: "quiet", Silent: true, Role: string(Dapp), client: dapp})
+	ws.legacyPubMessage(SocketMessage{Topic: "hello", Type: Pub, Payload: "world", Role: string(Dapp), client: dapp})
+
+	select {
+	case notification := <-received:
+		if notification.Topic != "hello" {
+			t.Errorf("topic error, expected: %v, actual: %v", "hello", notification.Topic)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("webhook not called")
+	}
+	// the silent message doesn't wake up the wallet
+	select {
+	case notification := <-received:
+		t.Errorf("webhook should be called once, actual: %+v", notification)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
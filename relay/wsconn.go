@@ -3,8 +3,15 @@ package relay
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/RabbyHub/derelay/config"
 	"github.com/RabbyHub/derelay/log"
 	"github.com/RabbyHub/derelay/metrics"
 	"github.com/gorilla/websocket"
@@ -12,40 +19,113 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
+// time allowed to write a control message to the peer
+const writeWait = 10 * time.Second
+
+// close code sent to the clients disconnected for not keeping up with their messages
+const closeSlowConsumer = 4008
+
 type client struct {
 	conn *websocket.Conn
 	ws   *WsServer
 
-	id        string   // randomly generate, just for logging
-	role      RoleType // dapp or wallet
-	pubTopics *TopicSet
-	subTopics *TopicSet
+	id       string   // randomly generate, just for logging
+	ip       string   // the source ip, for rate limiting
+	role     RoleType // dapp or wallet
+	protocol ProtocolVersion
+
+	limiter    *tokenBucket // rate limit of the messages, nil if unlimited
+	violations int          // number of messages exceeding the rate limit, only accessed by the read loop
+
+	sendbuf   chan SocketMessage // send buffer
+	overflows atomic.Int64       // number of messages overflowing the send buffer
+	gone      atomic.Bool        // set once the client is disconnected, it's not added to the topics any more
+	quit      chan struct{}
 
-	sendbuf chan SocketMessage // send buffer
-	quit    chan struct{}
+	closeOnce    sync.Once
+	closeMessage []byte        // the close frame to send
+	closing      chan struct{} // closed to ask the write loop to flush and close the connection
+	closed       chan struct{} // closed once the close frame has been sent, or the write loop has quit
+	closedOnce   sync.Once
 }
 
 func (c *client) MarshalLogObject(encoder zapcore.ObjectEncoder) error {
 	if c != nil {
 		encoder.AddString("id", c.id)
 		encoder.AddString("role", string(c.role))
-		encoder.AddArray("pubTopics", c.pubTopics)
-		encoder.AddArray("subTopics", c.subTopics)
+		if c.ws != nil {
+			encoder.AddArray("pubTopics", topicsMarshaler(c.ws.publishers.GetTopicsByClient(c, false)))
+			encoder.AddArray("subTopics", topicsMarshaler(c.ws.subscribers.GetTopicsByClient(c, false)))
+		}
+		if overflows := c.overflows.Load(); overflows > 0 {
+			encoder.AddInt64("overflows", overflows)
+		}
 	}
 	return nil
 }
 
+func topicsMarshaler(topics []string) zapcore.ArrayMarshaler {
+	return zapcore.ArrayMarshalerFunc(func(encoder zapcore.ArrayEncoder) error {
+		for _, topic := range topics {
+			encoder.AppendString(topic)
+		}
+		return nil
+	})
+}
+
+// heartbeat returns the websocket ping interval and the time allowed to read the next pong,
+// zero means the heartbeat is disabled
+func (c *client) heartbeat() (pingPeriod, pongWait time.Duration) {
+	pingPeriod = time.Duration(c.ws.config.HeartbeatInterval) * time.Second
+	// allow missing one pong before considering the connection dead
+	return pingPeriod, 2 * pingPeriod
+}
+
+// extendReadDeadline is called everytime the client shows it's alive
+func (c *client) extendReadDeadline() {
+	if _, pongWait := c.heartbeat(); pongWait > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	}
+}
+
 func (c *client) read() {
+	if max := c.ws.config.MaxFrameSize; max > 0 {
+		c.conn.SetReadLimit(max)
+	}
+	c.extendReadDeadline()
+	c.conn.SetPongHandler(func(string) error {
+		c.extendReadDeadline()
+		return nil
+	})
+
 	for {
 		_, m, err := c.conn.ReadMessage()
 		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				metrics.IncHeartbeatTimeout()
+			}
+			// the connection has been closed with 1009(message too big) by the websocket library
+			if errors.Is(err, websocket.ErrReadLimit) {
+				metrics.IncOversizeMessage("frame")
+			}
 			c.terminate(err)
 			return
 		}
+		c.extendReadDeadline()
+
+		// the protocol is determined by the first message of the connection
+		if c.protocol == "" {
+			c.protocol = detectProtocol(m)
+		}
+		if c.protocol == V2 {
+			c.readRpc(m)
+			continue
+		}
 
 		message := SocketMessage{}
 		if err := json.NewDecoder(bytes.NewReader(m)).Decode(&message); err != nil {
 			log.Warn("[wsconn] received malformed text message", zap.Error(err), zap.String("raw", string(m)))
+			c.ws.sendError(c, "", ErrorMalformed, "malformed message")
 			continue
 		}
 
@@ -54,37 +134,275 @@ func (c *client) read() {
 		c.role = RoleType(strings.ToLower(message.Role))
 
 		message.client = c
-		c.ws.localCh <- message
+		if !c.allow(message) || !c.withinLimits(message) || !c.validTopics(message) || !c.admitSubscription(message) {
+			continue
+		}
+		c.ws.dispatch(message)
 	}
 }
 
+// readRpc translates a v2 json-rpc request into the SocketMessage handled by the wsserver
+func (c *client) readRpc(m []byte) {
+	req := JsonRpcRequest{}
+	if err := json.Unmarshal(m, &req); err != nil {
+		log.Warn("[wsconn] received malformed json-rpc message", zap.Error(err), zap.String("raw", string(m)))
+		c.send(rpcReply(nil, nil, &JsonRpcError{Code: JsonRpcParseError, Message: "parse error"}))
+		return
+	}
+
+	// responses from the peer, e.g. the ones to our `irn_subscription` requests, need no further handling
+	if req.Method == "" {
+		return
+	}
+
+	message, rpcErr := req.toSocketMessage()
+	if rpcErr != nil {
+		log.Warn("[wsconn] received invalid json-rpc request", zap.Any("error", rpcErr), zap.String("raw", string(m)))
+		c.send(rpcReply(message.call, nil, rpcErr))
+		return
+	}
+
+	message.client = c
+	if !c.allow(message) || !c.withinLimits(message) || !c.validTopics(message) || !c.admitSubscription(message) {
+		return
+	}
+	c.ws.dispatch(message)
+}
+
+// withinLimits checks the sizes of the payload and the topics, the oversize message is rejected with an error
+func (c *client) withinLimits(message SocketMessage) bool {
+	limit, reason := "", ""
+	if max := c.ws.config.MaxPayloadSize; max > 0 && len(message.Payload) > max {
+		limit, reason = "payload", fmt.Sprintf("payload exceeds %v bytes", max)
+	}
+	if max := c.ws.config.MaxTopicLength; max > 0 {
+		for _, topic := range message.topics() {
+			if len(topic) > max {
+				limit, reason = "topic", fmt.Sprintf("topic exceeds %v characters", max)
+			}
+		}
+	}
+	if limit == "" {
+		return true
+	}
+
+	metrics.IncOversizeMessage(limit)
+	log.Warn("reject oversize message", zap.Any("client", c), zap.String("limit", limit))
+	if message.call != nil {
+		c.send(rpcReply(message.call, nil, &JsonRpcError{Code: JsonRpcInvalidParams, Message: reason}))
+		return false
+	}
+	// don't echo the oversize topic back
+	topic := message.Topic
+	if limit == "topic" {
+		topic = ""
+	}
+	c.ws.sendError(c, topic, ErrorTooLarge, reason)
+	return false
+}
+
+// allow checks the message against the rate limits of the connection and its ip, the client is told
+// about the limited message, and disconnected if it keeps exceeding the limits
+func (c *client) allow(message SocketMessage) bool {
+	now := time.Now()
+	limit := ""
+	switch {
+	case !c.limiter.allow(now):
+		limit = "message"
+	case !c.ws.ipMessages.allow(c.ip, now):
+		limit = "ip_message"
+	default:
+		return true
+	}
+
+	metrics.IncRateLimited(limit)
+	c.violations++
+	if c.violations == 1 {
+		log.Warn("client exceeds the rate limit", zap.Any("client", c), zap.String("ip", c.ip), zap.String("limit", limit))
+	}
+
+	reason := "rate limit exceeded"
+	if message.call != nil {
+		c.send(rpcReply(message.call, nil, &JsonRpcError{Code: JsonRpcLimitExceeded, Message: reason}))
+	} else {
+		c.ws.sendError(c, message.Topic, ErrorRateLimited, reason)
+	}
+	if max := c.ws.config.RateLimitViolations; max > 0 && c.violations >= max {
+		c.close(closeRateLimited, reason)
+	}
+	return false
+}
+
+// encode serializes the message according to the protocol of the connection,
+// a nil result means the message is not applicable to the client and should be skipped
+func (c *client) encode(message SocketMessage) ([]byte, error) {
+	if c.protocol != V2 {
+		m := new(bytes.Buffer)
+		if err := json.NewEncoder(m).Encode(message); err != nil {
+			return nil, err
+		}
+		return m.Bytes(), nil
+	}
+
+	if message.reply != nil {
+		return json.Marshal(message.reply)
+	}
+	if message.Type == Pub {
+		return encodeSubscription(c, message)
+	}
+	return nil, nil
+}
+
 func (c *client) write() {
+	// a nil channel blocks forever if the heartbeat is disabled
+	var pingCh <-chan time.Time
+	if pingPeriod, _ := c.heartbeat(); pingPeriod > 0 {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		pingCh = ticker.C
+	}
+	closing := c.closing
+	closeSent := false
+	// the client may quit without being closed, e.g. the peer leaves, don't let anyone wait for it forever
+	defer c.markClosed()
+
 	for {
 		select {
+		case <-pingCh:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				// closing the connection makes `read()` fail and terminate the client
+				log.Debug("client ping error", zap.Any("client", c), zap.Error(err))
+				c.conn.Close()
+			}
 		case message := <-c.sendbuf:
-			m := new(bytes.Buffer)
-			if err := json.NewEncoder(m).Encode(message); err != nil {
-				log.Warn("sending malformed text message", zap.Error(err))
+			// nothing can be written after the close frame, keep the relayed messages for the client to reconnect
+			if closeSent {
+				c.recache(message)
 				continue
 			}
-			err := c.conn.WriteMessage(websocket.TextMessage, m.Bytes())
-			if err != nil {
+			if err := c.writeMessage(message); err != nil {
 				log.Error("client write error", err, zap.Any("client", c), zap.Any("message", message))
 				continue
 			}
+			c.delivered(message)
+		case <-closing:
+			// keep waiting for `quit` as `read()` will terminate the client once the peer closes the connection
+			closing, pingCh, closeSent = nil, nil, true
+			c.flush()
+			c.conn.WriteControl(websocket.CloseMessage, c.closeMessage, time.Now().Add(writeWait))
+			c.markClosed()
+			// don't wait for the peer forever, closing the connection makes `read()` fail and terminate the client
+			time.AfterFunc(writeWait, func() { c.conn.Close() })
 		case <-c.quit:
 			return
 		}
 	}
 }
 
+func (c *client) writeMessage(message SocketMessage) error {
+	m, err := c.encode(message)
+	if err != nil {
+		log.Warn("sending malformed text message", zap.Error(err))
+		return nil
+	}
+	if m == nil {
+		return nil
+	}
+	return c.conn.WriteMessage(websocket.TextMessage, m)
+}
+
+// delivered is called once the message has been written to the connection
+func (c *client) delivered(message SocketMessage) {
+	if message.Type != Pub {
+		return
+	}
+	if message.streamID != "" {
+		go c.ws.ackStream(message)
+	}
+	if message.ID != "" {
+		go c.ws.confirmDelivery(message)
+	}
+}
+
+// flush writes out the messages left in the send buffer, the relayed messages which fail to
+// be written are cached for the client to receive them after reconnecting
+func (c *client) flush() {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	for {
+		select {
+		case message := <-c.sendbuf:
+			if err := c.writeMessage(message); err != nil {
+				c.recache(message)
+				continue
+			}
+			c.delivered(message)
+		default:
+			return
+		}
+	}
+}
+
+// recache caches the message which can't be written, if it's a relayed one
+func (c *client) recache(message SocketMessage) {
+	if message.recache {
+		metrics.IncCachedMessages()
+		c.ws.cacheMessage(message)
+	}
+}
+
+// close asks the write loop to flush the pending messages and close the connection with the code
+func (c *client) close(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.closeMessage = websocket.FormatCloseMessage(code, text)
+		close(c.closing)
+	})
+}
+
+// markClosed tells the client won't write to the connection any more
+func (c *client) markClosed() {
+	c.closedOnce.Do(func() {
+		close(c.closed)
+	})
+}
+
 // send implements a non-blocking sending
 func (c *client) send(message SocketMessage) {
 	select {
 	case c.sendbuf <- message:
 	default:
-		metrics.IncSendBlocking()
+		c.overflow(message)
+	}
+}
+
+// overflow applies the slow consumer policy to the message which can't be buffered
+func (c *client) overflow(message SocketMessage) {
+	metrics.IncSendBlocking()
+	if c.overflows.Add(1) == 1 {
+		log.Warn("client send buffer is full", zap.Any("client", c), zap.String("policy", c.ws.config.SlowConsumerPolicy))
 	}
+
+	switch c.ws.config.SlowConsumerPolicy {
+	case config.SlowConsumerCache:
+		// only the relayed messages are worth caching, e.g. not the notifications for the dapps
+		if message.recache {
+			metrics.IncSlowConsumerMessage("cached")
+			metrics.IncCachedMessages()
+			// it may be called in the wsserver main loop, don't block it
+			go c.ws.cacheMessage(message)
+			return
+		}
+	case config.SlowConsumerDisconnect:
+		metrics.IncSlowConsumerMessage("disconnected")
+		c.close(closeSlowConsumer, "slow consumer")
+		// the pending messages are flushed on closing, while this one can't be buffered anymore
+		if message.recache {
+			go c.ws.cacheMessage(message)
+		}
+		return
+	}
+
+	metrics.IncSlowConsumerMessage("dropped")
+	log.Debug("drop message", zap.Any("client", c), zap.Any("message", message))
 }
 
 func (c *client) terminate(reason error) {
@@ -1,10 +1,16 @@
 package relay
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/RabbyHub/derelay/config"
+	"github.com/gorilla/websocket"
 )
 
 func TestSendChanWithNoReceiver(t *testing.T) {
@@ -45,3 +51,215 @@ func TestSendChanWithNoReceiver(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestHeartbeatTimeout(t *testing.T) {
+	ws := &WsServer{
+		config:     &config.WsConfig{HeartbeatInterval: 1},
+		unregister: make(chan ClientUnregisterEvent, 1),
+	}
+
+	// the peer never reads, so the pings are never answered
+	newTestConn(t, ws, nil)
+
+	select {
+	case event := <-ws.unregister:
+		if netErr, ok := event.reason.(net.Error); !ok || !netErr.Timeout() {
+			t.Errorf("unregister reason error, expected timeout, actual: %v", event.reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("dead connection not detected")
+	}
+}
+
+func TestCloseFlushesPendingMessages(t *testing.T) {
+	ws := &WsServer{
+		config:     &config.WsConfig{},
+		unregister: make(chan ClientUnregisterEvent, 1),
+	}
+
+	conn := newTestConn(t, ws, func(c *client) {
+		c.sendbuf <- SocketMessage{Topic: "hello", Type: Pub, Payload: "1"}
+		c.sendbuf <- SocketMessage{Topic: "hello", Type: Pub, Payload: "2"}
+		c.close(websocket.CloseGoingAway, "relay shutting down")
+	})
+
+	received := 0
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				t.Errorf("close error, expected: %v, actual: %v", websocket.CloseGoingAway, err)
+			}
+			break
+		}
+		received++
+	}
+	if received != 2 {
+		t.Errorf("length error, expected: %v, actual: %v", 2, received)
+	}
+}
+
+func TestDrainTerminatedClients(t *testing.T) {
+	conf := config.LoadConfig("")
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+
+	clients := make(chan *client, 1)
+	conn := newTestConn(t, ws, func(c *client) { clients <- c })
+	wallet := <-clients
+	ws.clients[wallet] = struct{}{}
+
+	// the peer leaves right before the relay shuts down
+	conn.Close()
+	select {
+	case <-wallet.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client should be closed once its write loop quits")
+	}
+	for i := 0; i < 100 && len(ws.unregister) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ws.drain()
+	if len(ws.clients) != 0 {
+		t.Errorf("terminated client should be unregistered, clients: %v", len(ws.clients))
+	}
+}
+
+func TestMessagesAfterCloseRecached(t *testing.T) {
+	conf := config.LoadConfig("")
+	store := NewMemoryMessageStore(&conf.CacheConfig)
+	ws := NewWSServerWithBackend(&conf, NewMemoryBroker(), store)
+
+	clients := make(chan *client, 1)
+	newTestConn(t, ws, func(c *client) {
+		c.close(websocket.CloseGoingAway, "relay shutting down")
+		clients <- c
+	})
+	wallet := <-clients
+	select {
+	case <-wallet.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("close frame not sent")
+	}
+
+	// the peer hasn't closed the connection yet, while the relayed messages keep coming
+	wallet.send(SocketMessage{Topic: "hello", Type: Pub, Payload: "relayed", recache: true})
+	wallet.send(SocketMessage{Topic: "hello", Type: Pub, Payload: "notification"})
+	var messages []SocketMessage
+	for i := 0; i < 100 && len(messages) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		messages, _ = store.Range(context.TODO(), "hello")
+	}
+	if len(messages) != 1 || messages[0].Payload != "relayed" {
+		t.Errorf("relayed message should be cached, actual: %+v", messages)
+	}
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	conf := config.LoadConfig("")
+	store := NewMemoryMessageStore(&conf.CacheConfig)
+	ws := NewWSServerWithBackend(&conf, NewMemoryBroker(), store)
+
+	newSlowClient := func(policy string) *client {
+		ws.config.SlowConsumerPolicy = policy
+		c := newTestClient(ws)
+		c.sendbuf = make(chan SocketMessage, 1)
+		c.closing = make(chan struct{})
+		c.send(SocketMessage{Topic: "hello", Type: Pub, Payload: "1", recache: true})
+		c.send(SocketMessage{Topic: "hello", Type: Pub, Payload: "2", recache: true})
+		if overflows := c.overflows.Load(); overflows != 1 {
+			t.Errorf("overflows error, expected: %v, actual: %v", 1, overflows)
+		}
+		return c
+	}
+
+	newSlowClient(config.SlowConsumerDrop)
+	if messages, _ := store.Drain(context.TODO(), "hello"); len(messages) != 0 {
+		t.Errorf("length error, expected: %v, actual: %v", 0, len(messages))
+	}
+
+	newSlowClient(config.SlowConsumerCache)
+	var messages []SocketMessage
+	for i := 0; i < 100 && len(messages) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		messages, _ = store.Drain(context.TODO(), "hello")
+	}
+	if len(messages) != 1 || messages[0].Payload != "2" {
+		t.Errorf("overflowing message should be cached, actual: %v", messages)
+	}
+
+	// the notifications for the dapp aren't cached for the wallet
+	c := newTestClient(ws)
+	c.sendbuf = make(chan SocketMessage, 0)
+	c.send(SocketMessage{Topic: "hello", Type: Pub, Role: string(Relay), Phase: string(SessionSuspended)})
+	time.Sleep(10 * time.Millisecond)
+	if messages, _ := store.Drain(context.TODO(), "hello"); len(messages) != 0 {
+		t.Errorf("notification should not be cached, actual: %v", messages)
+	}
+
+	c = newSlowClient(config.SlowConsumerDisconnect)
+	select {
+	case <-c.closing:
+	default:
+		t.Errorf("slow consumer should be disconnected")
+	}
+}
+
+func TestFrameSizeLimit(t *testing.T) {
+	ws := &WsServer{
+		config:     &config.WsConfig{MaxFrameSize: 16},
+		unregister: make(chan ClientUnregisterEvent, 1),
+	}
+
+	conn := newTestConn(t, ws, nil)
+	conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 100)))
+
+	select {
+	case event := <-ws.unregister:
+		if event.reason != websocket.ErrReadLimit {
+			t.Errorf("unregister reason error, expected: %v, actual: %v", websocket.ErrReadLimit, event.reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("oversize frame not rejected")
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("close error, expected: %v, actual: %v", websocket.CloseMessageTooBig, err)
+	}
+}
+
+func TestMessageSizeLimits(t *testing.T) {
+	conf := config.LoadConfig("")
+	conf.WsServerConfig.MaxPayloadSize = 8
+	conf.WsServerConfig.MaxTopicLength = 8
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+	c := newTestClient(ws)
+
+	if !c.withinLimits(SocketMessage{Topic: "hello", Type: Pub, Payload: "world"}) {
+		t.Errorf("message within limits should be allowed")
+	}
+
+	if c.withinLimits(SocketMessage{Topic: "hello", Type: Pub, Payload: "hello world"}) {
+		t.Errorf("oversize payload should be rejected")
+	}
+	if reply := <-c.sendbuf; reply.Type != Error || reply.Code != ErrorTooLarge || reply.Topic != "hello" {
+		t.Errorf("size error should be sent, actual: %+v", reply)
+	}
+
+	if c.withinLimits(SocketMessage{Topic: "hello world", Type: Sub}) {
+		t.Errorf("oversize topic should be rejected")
+	}
+	if reply := <-c.sendbuf; reply.Type != Error || reply.Code != ErrorTooLarge || reply.Topic != "" {
+		t.Errorf("size error should be sent without the topic, actual: %+v", reply)
+	}
+
+	c.protocol = V2
+	call := &rpcCall{id: []byte("1"), topics: []string{"hello", "hello world"}}
+	if c.withinLimits(SocketMessage{Type: IrnBatchSubscribe, call: call}) {
+		t.Errorf("oversize topic should be rejected")
+	}
+	if reply := <-c.sendbuf; reply.reply == nil || reply.reply.Error == nil || reply.reply.Error.Code != JsonRpcInvalidParams {
+		t.Errorf("json-rpc error should be replied, actual: %+v", reply.reply)
+	}
+}
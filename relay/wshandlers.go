@@ -2,6 +2,7 @@ package relay
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/RabbyHub/derelay/log"
@@ -11,57 +12,144 @@ import (
 
 type WsMessageHandler func(*WsServer, SocketMessage)
 
+// v1Handlers handle the v1 messages exactly as the official spec describes
+var v1Handlers = map[MessageType]WsMessageHandler{
+	Pub: (*WsServer).pubMessage,
+	Sub: (*WsServer).subMessage,
+}
+
+// legacyHandlers handle the v1 messages with the Rabby extensions, i.e. the `role`, `phase` and `id`
+// fields, the delivery acks and the application layer ping/pong
+var legacyHandlers = map[MessageType]WsMessageHandler{
+	Pub:   (*WsServer).legacyPubMessage,
+	Sub:   (*WsServer).legacySubMessage,
+	Unsub: (*WsServer).unsubMessage,
+	Ack:   (*WsServer).legacyAckMessage,
+	Ping:  (*WsServer).handlePingMessage,
+}
+
+var v2Handlers = map[MessageType]WsMessageHandler{
+	IrnPublish:        (*WsServer).irnPublish,
+	IrnSubscribe:      (*WsServer).irnSubscribe,
+	IrnBatchSubscribe: (*WsServer).irnSubscribe,
+	IrnUnsubscribe:    (*WsServer).irnUnsubscribe,
+}
+
 func (ws *WsServer) pubMessage(message SocketMessage) {
+	// v1 has no way to tell the publisher about the failure, the error has been logged
+	ws.publishMessage(message)
+}
+
+func (ws *WsServer) legacyPubMessage(message SocketMessage) {
 	topic := message.Topic
 	publisher := message.client
 
 	if message.Role == string(Dapp) {
-		// this `notifyDappChanName(topic)` redis channel is used to notify dapp the wallet's status
-		ws.redisSubConn.Subscribe(context.TODO(), dappNotifyChanKey(topic))
+		// this `dappNotifyChanKey(topic)` broker channel is used to notify dapp the wallet's status
+		if err := ws.broker.Subscribe(context.TODO(), dappNotifyChanKey(topic)); err != nil {
+			metrics.IncBrokerError("subscribe")
+			log.Warn("[broker] subscribe to dapp notify channel fail", zap.String("topic", topic), zap.Error(err))
+			ws.sendError(publisher, topic, ErrorSubscribe, "subscribe to wallet notifications failed")
+		}
 		if message.Phase == string(SessionStart) {
 			metrics.IncEstablishedSessions()
 			return
 		}
 	}
 
+	// the dapp is acked with the message id once the message is written to the wallet, see `confirmDelivery`
+	if message.ID == "" {
+		message.ID = generateRandomBytes16()
+	}
+	delivered, err := ws.publishMessage(message)
+	if isCacheRejection(err) {
+		ws.sendError(publisher, topic, ErrorCacheFull, err.Error())
+		return
+	}
+	if err != nil {
+		ws.sendError(publisher, topic, ErrorPublish, "publish failed")
+		return
+	}
+	log.Debug("message relayed", zap.Any("client", publisher), zap.String("id", message.ID), zap.Bool("delivered", delivered))
+
+	// keep an eye on the unscanned session request, the dapp will be notified when it expires
+	if !delivered && message.Phase == string(SessionRequest) {
+		ws.sessions.add(topic, time.Now().Add(time.Duration(ws.config.PendingSessionCacheTime)*time.Second))
+	}
+}
+
+// publishMessage publishes the message to the topic subscribers, the message is cached if there's no subscriber,
+// returns whether the message has been published to any subscriber, an error is returned if the broker fails or
+// the message can't be cached
+//
+// with stream delivery, the message is added to the stream of the topic before being published, the published
+// message only tells the subscribing relay nodes to read the stream
+func (ws *WsServer) publishMessage(message SocketMessage) (bool, error) {
+	topic := message.Topic
+	publisher := message.client
+
 	log.Debug("publish message", zap.Any("client", publisher), zap.Any("topic", message.Topic))
 
 	metrics.IncTotalMessages()
+	message.ExpireAt = time.Now().Add(ws.messageTTL(message)).UnixMilli()
+	if ws.stream != nil {
+		if err := ws.stream.Add(context.TODO(), topic, message); err != nil {
+			metrics.IncBrokerError("stream")
+			log.Warn("[stream] add message fail", zap.Any("client", publisher), zap.String("topic", topic), zap.Error(err))
+			return false, err
+		}
+	}
+
 	key := messageChanKey(topic)
-	if count, _ := ws.redisConn.Publish(context.TODO(), key, message).Result(); count >= 1 {
-		log.Debug("message published", zap.Any("client", publisher), zap.Any("topic", topic))
-		if publisher.role == Dapp {
-			publisher.send(SocketMessage{
-				Topic: message.Topic,
-				Type:  Ack,
-				Role:  string(Wallet),
-			})
+	count, err := ws.broker.Publish(context.TODO(), key, message)
+	if err != nil {
+		metrics.IncBrokerError("publish")
+		log.Warn("[broker] publish message fail", zap.Any("client", publisher), zap.String("topic", topic), zap.Error(err))
+		// the message kept in the stream will be received once the subscriber subscribes again
+		if ws.stream != nil {
+			return false, nil
 		}
-	} else {
-		log.Debug("cache message", zap.Any("client", publisher), zap.Any("topic", topic))
-		metrics.IncCachedMessages()
-		if message.Phase == string(SessionRequest) {
-			metrics.IncNewRequestedSessions()
+		// don't take it as no subscriber, the subscriber may be online with the broker unreachable
+		return false, err
+	}
+	if count >= 1 {
+		log.Debug("message published", zap.Any("client", publisher), zap.Any("topic", topic))
+		return true, nil
+	}
+
+	log.Debug("cache message", zap.Any("client", publisher), zap.Any("topic", topic))
+	if ws.stream == nil {
+		if err := ws.cacheMessage(message); err != nil {
+			return false, err
 		}
-		ws.cacheMessage(message, ws.config.MessageCacheTime)
 	}
+	metrics.IncCachedMessages()
+	if message.Phase == string(SessionRequest) {
+		metrics.IncNewRequestedSessions()
+	}
+	// wake up the sleeping wallet, unless the publisher asks not to
+	if !message.Silent {
+		go ws.pushNotify(topic)
+	}
+	return false, nil
 }
 
 func (ws *WsServer) subMessage(message SocketMessage) {
+	if err := ws.subscribeTopic(message.client, message.Topic); err != nil {
+		ws.sendError(message.client, message.Topic, ErrorSubscribe, "subscribe failed")
+	}
+	// the cached messages can be received anyway
+	ws.forwardCachedMessages(message.client, message.Topic)
+}
+
+func (ws *WsServer) legacySubMessage(message SocketMessage) {
 	topic := message.Topic
 	subscriber := message.client
 
-	if err := ws.redisSubConn.Subscribe(context.TODO(), messageChanKey(topic)); err != nil {
-		log.Warn("[redisSub] subscribe to topic fail", zap.String("topic", topic), zap.Any("client", subscriber))
-	}
-	log.Debug("subscribe to topic", zap.String("topic", topic), zap.Any("client", subscriber))
-
-	// forward cached notificatoins if there's any
-	notifications := ws.getCachedMessages(topic, true)
-	log.Debug("pending notifications", zap.String("topic", topic), zap.Any("num", len(notifications)), zap.Any("client", subscriber))
-	for _, notification := range notifications {
-		subscriber.send(notification)
+	if err := ws.subscribeTopic(subscriber, topic); err != nil {
+		ws.sendError(subscriber, topic, ErrorSubscribe, "subscribe failed")
 	}
+	notifications := ws.forwardCachedMessages(subscriber, topic)
 
 	// we need do some more work if it's a wallet that subscribes the topic
 	if message.Role != string(Dapp) {
@@ -86,8 +174,7 @@ func (ws *WsServer) subMessage(message SocketMessage) {
 				log.Debug("session been scanned", zap.Any("topic", topic), zap.Any("client", subscriber))
 
 				// notify the topic publisher, aka the dapp, that the session request has been received by wallet
-				key := dappNotifyChanKey(noti.Topic)
-				ws.redisConn.Publish(context.TODO(), key, SocketMessage{
+				ws.notifyDapp(SocketMessage{
 					Topic: noti.Topic,
 					Phase: string(SessionReceived),
 					Type:  Ack,
@@ -99,8 +186,7 @@ func (ws *WsServer) subMessage(message SocketMessage) {
 		// handle the 2nd case
 		// NOTE we could check for whether the notifactions of this topic is session request, we don't need reply `sessionResumed`
 		// for sessionRequest message, but for simplity we don't do that check here
-		key := dappNotifyChanKey(message.Topic)
-		ws.redisConn.Publish(context.TODO(), key, SocketMessage{
+		ws.notifyDapp(SocketMessage{
 			Topic: message.Topic,
 			Type:  Pub,
 			Role:  string(Relay),
@@ -109,6 +195,119 @@ func (ws *WsServer) subMessage(message SocketMessage) {
 	}
 }
 
+// unsubMessage handles the "unsub" message, the topic has already been removed from the client's
+// subscriptions in the event loop, see `updateTopics`
+func (ws *WsServer) unsubMessage(message SocketMessage) {
+	log.Debug("unsubscribe from topic", zap.String("topic", message.Topic), zap.Any("client", message.client))
+}
+
+// subscribeTopic subscribes the broker channel of the topic on behalf of the client
+func (ws *WsServer) subscribeTopic(subscriber *client, topic string) error {
+	if err := ws.broker.Subscribe(context.TODO(), messageChanKey(topic)); err != nil {
+		metrics.IncBrokerError("subscribe")
+		log.Warn("[broker] subscribe to topic fail", zap.String("topic", topic), zap.Any("client", subscriber), zap.Error(err))
+		return err
+	}
+	log.Debug("subscribe to topic", zap.String("topic", topic), zap.Any("client", subscriber))
+	return nil
+}
+
+// forwardCachedMessages forwards the cached messages of the topic to the subscriber if there's any,
+// returns the forwarded messages
+func (ws *WsServer) forwardCachedMessages(subscriber *client, topic string) []SocketMessage {
+	notifications := ws.getCachedMessages(topic)
+	log.Debug("pending notifications", zap.String("topic", topic), zap.Any("num", len(notifications)), zap.Any("client", subscriber))
+	for _, notification := range notifications {
+		// the messages read from the stream will be delivered again as they're not acknowledged
+		notification.recache = notification.streamID == ""
+		subscriber.send(notification)
+	}
+	return notifications
+}
+
+// sweepExpiredSessions periodically notifies the dapps whose session requests have expired unscanned
+func (ws *WsServer) sweepExpiredSessions() {
+	interval := time.Duration(ws.config.CheckSessionExpireInterval) * time.Second
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			ws.expireSessions(now)
+		case <-ws.quit:
+			return
+		}
+	}
+}
+
+// expireSessions notifies the dapps whose session requests have expired by `now`
+func (ws *WsServer) expireSessions(now time.Time) {
+	for _, topic := range ws.sessions.popExpired(now) {
+		metrics.IncExpiredSessions()
+		log.Debug("session expired", zap.String("topic", topic))
+
+		// the session request is useless from now on, don't let a late wallet receive it
+		ws.store.Delete(context.TODO(), topic)
+		if ws.stream != nil {
+			ws.stream.Delete(context.TODO(), topic)
+		}
+
+		ws.notifyDapp(SocketMessage{
+			Topic: topic,
+			Type:  Pub,
+			Role:  string(Relay),
+			Phase: string(SessionExpired),
+		})
+	}
+}
+
+// confirmDelivery acks the dapp that the message has been written to the subscriber's connection,
+// it's called by the node delivering the message
+func (ws *WsServer) confirmDelivery(message SocketMessage) {
+	if message.ID == "" || message.Role != string(Dapp) {
+		return
+	}
+	ws.notifyDapp(SocketMessage{
+		Topic: message.Topic,
+		Type:  Ack,
+		Role:  string(Relay),
+		ID:    message.ID,
+	})
+}
+
+// legacyAckMessage forwards the wallet's ack of a received message to the dapp publishing it
+func (ws *WsServer) legacyAckMessage(message SocketMessage) {
+	wallet := message.client
+	if message.ID == "" {
+		log.Debug("ack without message id", zap.Any("client", wallet), zap.Any("message", message))
+		return
+	}
+	// only the subscribers have received messages of the topic
+	if !ws.subscribers.Has(message.Topic, wallet) {
+		log.Warn("ack of unsubscribed topic", zap.Any("client", wallet), zap.Any("message", message))
+		return
+	}
+	ws.notifyDapp(SocketMessage{
+		Topic: message.Topic,
+		Type:  Ack,
+		Role:  string(Wallet),
+		ID:    message.ID,
+	})
+}
+
+// notifyDapp publishes the notification to the dapps publishing the topic
+func (ws *WsServer) notifyDapp(notification SocketMessage) {
+	key := dappNotifyChanKey(notification.Topic)
+	if _, err := ws.broker.Publish(context.TODO(), key, notification); err != nil {
+		metrics.IncBrokerError("publish")
+		log.Warn("[broker] notify dapp fail", zap.Any("notification", notification), zap.Error(err))
+	}
+}
+
 func (ws *WsServer) handlePingMessage(message SocketMessage) {
 	// response to application layer ping message
 	client := message.client
@@ -118,67 +317,122 @@ func (ws *WsServer) handlePingMessage(message SocketMessage) {
 	})
 }
 
-func (ws *WsServer) cacheMessage(message SocketMessage, cacheTime int) {
-	key := cachedMessageKey(message.Topic)
-	// Store the notification in Redis with the topic as the key
-	if _, err := ws.redisConn.RPush(context.TODO(), key, message).Result(); err != nil {
-		log.Warn("cache message to redis fail", zap.Any("message", message), zap.Error(err))
-		return
+// messageTTL returns the time the message is cached for, the ttl requested by the publisher is clamped
+// to [`MinMessageTTL`, `MaxMessageTTL`]
+func (ws *WsServer) messageTTL(message SocketMessage) time.Duration {
+	ttl := ws.config.MessageCacheTime
+	if message.TTL > 0 {
+		ttl = message.TTL
+		if ws.config.MinMessageTTL > 0 && ttl < ws.config.MinMessageTTL {
+			ttl = ws.config.MinMessageTTL
+		}
+		if ws.config.MaxMessageTTL > 0 && ttl > ws.config.MaxMessageTTL {
+			ttl = ws.config.MaxMessageTTL
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// cacheMessage caches the message until it expires
+func (ws *WsServer) cacheMessage(message SocketMessage) error {
+	// the message may be relayed by a node which doesn't set the expiry
+	if message.ExpireAt == 0 {
+		message.ExpireAt = time.Now().Add(ws.messageTTL(message)).UnixMilli()
+	}
+	ttl := time.Until(time.UnixMilli(message.ExpireAt))
+	if ttl <= 0 {
+		log.Debug("drop expired message", zap.Any("message", message))
+		return nil
 	}
-	if _, err := ws.redisConn.Expire(context.TODO(), key, time.Duration(cacheTime)*time.Second).Result(); err != nil {
-		log.Warn("set expire for cache message failed", zap.Any("key", key), zap.Any("ttl", cacheTime))
+
+	evicted, err := ws.store.Append(context.TODO(), message.Topic, message, ttl)
+	switch {
+	case errors.Is(err, errCacheQuotaExceeded):
+		metrics.IncCacheRejection("quota")
+	case errors.Is(err, errCacheBudgetExceeded):
+		metrics.IncCacheRejection("budget")
+	}
+	if err != nil {
+		log.Warn("cache message fail", zap.Any("message", message), zap.Error(err))
+		return err
+	}
+
+	if evicted > 0 {
+		metrics.AddCacheEvictions(evicted)
+		log.Debug("cached messages evicted", zap.String("topic", message.Topic), zap.Int("num", evicted))
+	}
+	return nil
+}
+
+// isCacheRejection checks whether the error is caused by the cache quota or budget
+func isCacheRejection(err error) bool {
+	return errors.Is(err, errCacheQuotaExceeded) || errors.Is(err, errCacheBudgetExceeded)
+}
+
+// sendError tells the client why its message is rejected, it's a Rabby extension only sent to
+// the v1 clients in legacy mode, the v2 clients are replied with json-rpc errors instead
+func (ws *WsServer) sendError(c *client, topic string, code ErrorCode, reason string) {
+	if !ws.extensions || c.protocol == V2 {
 		return
 	}
+	c.send(SocketMessage{
+		Topic:  topic,
+		Type:   Error,
+		Role:   string(Relay),
+		Code:   code,
+		Reason: reason,
+	})
 }
 
 func (ws *WsServer) handleClientDisconnect(client *client) {
+	// tell the event loops not to add the client to the topics any more
+	client.gone.Store(true)
 
 	// clear the client from the subscribed and published topics
 	channelsToClear := []string{}
-	//subscribedTopics := ws.subscribers.GetTopicsByClient(client, true)
-	subscribedTopics := client.subTopics.Get()
+	subscribedTopics := ws.subscribers.GetTopicsByClient(client, true)
 
-	for topic := range subscribedTopics {
-		ws.subscribers.Unset(topic, client)
+	for _, topic := range subscribedTopics {
 		if ws.subscribers.Len(topic) == 0 {
-			ws.subscribers.Clear(topic)
 			channelsToClear = append(channelsToClear, messageChanKey(topic))
 		}
 	}
-	for topic := range client.pubTopics.Get() {
-		ws.publishers.Unset(topic, client)
-		if ws.publishers.Len(topic) == 0 {
-			ws.publishers.Clear(topic)
-			channelsToClear = append(channelsToClear, messageChanKey(topic))
-			// for dapp, need to further clear notify channels
-			if client.role == Dapp {
-				channelsToClear = append(channelsToClear, dappNotifyChanKey(topic))
-			}
+	for _, topic := range ws.publishers.GetTopicsByClient(client, true) {
+		// for dapp, need to further clear notify channels
+		// NOTE the message channel of the topic is kept for its subscribers, publishing doesn't need it
+		if client.role == Dapp {
+			channelsToClear = append(channelsToClear, dappNotifyChanKey(topic))
 		}
 	}
 
 	if len(channelsToClear) > 0 {
 		log.Info("clear channels", zap.Any("client", client), zap.Any("channels", channelsToClear))
-		// !!! WARNING !!!
-		// Only call `Unsubscribe` when the length of `channelsToClear` IS NOT 0.
-		// Otherwise redis will unsubscribe all of the previous subscribed channels!!!
-		go ws.redisSubConn.Unsubscribe(context.TODO(), channelsToClear...)
+		go ws.unsubscribeChannels(channelsToClear...)
+	}
+
+	if ws.subscriberStore != nil && len(subscribedTopics) > 0 {
+		go ws.leaveTopics(client.id, subscribedTopics...)
 	}
 
 	// if the client is wallet, notify the topic publisher that wallet has disconnected
-	if client.role == Dapp {
-		return
+	for _, topic := range subscribedTopics {
+		ws.notifyWalletSuspended(client, topic)
 	}
-	for topic := range subscribedTopics {
-		go func(topic string) {
-			key := dappNotifyChanKey(topic)
-			ws.redisConn.Publish(context.TODO(), key, SocketMessage{
-				Topic: topic,
-				Type:  Pub,
-				Role:  string(Wallet),
-				Phase: string(SessionSuspended),
-			})
-			log.Debug("notify dapp about the wallet suspension", zap.Any("client", client))
-		}(topic)
+}
+
+// notifyWalletSuspended notifies the dapp that the wallet has left the topic, i.e. disconnected or unsubscribed,
+// the notification is a Rabby extension which v2 clients know nothing about
+func (ws *WsServer) notifyWalletSuspended(client *client, topic string) {
+	if !ws.extensions || client.role == Dapp || client.protocol == V2 {
+		return
 	}
+	go func() {
+		ws.notifyDapp(SocketMessage{
+			Topic: topic,
+			Type:  Pub,
+			Role:  string(Wallet),
+			Phase: string(SessionSuspended),
+		})
+		log.Debug("notify dapp about the wallet suspension", zap.Any("client", client), zap.String("topic", topic))
+	}()
 }
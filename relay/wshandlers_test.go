@@ -0,0 +1,562 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RabbyHub/derelay/config"
+	"github.com/gorilla/websocket"
+)
+
+// stubBackend is a Broker and MessageStore without any subscriber,
+// every published message ends up in the cache
+type stubBackend struct {
+	published  []SocketMessage
+	subscribed []string
+	cached     map[string][]SocketMessage
+	messages   chan *BrokerMessage
+	err        error // returned by the broker operations if set
+	cacheErr   error // returned by `Append` if set
+}
+
+func newStubBackend() *stubBackend {
+	return &stubBackend{
+		cached:   map[string][]SocketMessage{},
+		messages: make(chan *BrokerMessage),
+	}
+}
+
+func (sb *stubBackend) Publish(ctx context.Context, channel string, message SocketMessage) (int64, error) {
+	if sb.err != nil {
+		return 0, sb.err
+	}
+	sb.published = append(sb.published, message)
+	return 0, nil
+}
+func (sb *stubBackend) Subscribe(ctx context.Context, channels ...string) error {
+	if sb.err != nil {
+		return sb.err
+	}
+	sb.subscribed = append(sb.subscribed, channels...)
+	return nil
+}
+func (sb *stubBackend) Unsubscribe(ctx context.Context, channels ...string) error { return nil }
+func (sb *stubBackend) Presence(ctx context.Context, channel string) (int64, error) {
+	return 0, nil
+}
+func (sb *stubBackend) Messages() <-chan *BrokerMessage { return sb.messages }
+func (sb *stubBackend) Ping(ctx context.Context) error  { return sb.err }
+func (sb *stubBackend) Append(ctx context.Context, topic string, message SocketMessage, ttl time.Duration) (int, error) {
+	if sb.cacheErr != nil {
+		return 0, sb.cacheErr
+	}
+	sb.cached[topic] = append(sb.cached[topic], message)
+	return 0, nil
+}
+func (sb *stubBackend) Drain(ctx context.Context, topic string) ([]SocketMessage, error) {
+	messages := sb.cached[topic]
+	delete(sb.cached, topic)
+	return messages, nil
+}
+func (sb *stubBackend) Range(ctx context.Context, topic string) ([]SocketMessage, error) {
+	return sb.cached[topic], nil
+}
+func (sb *stubBackend) Delete(ctx context.Context, topic string) error {
+	delete(sb.cached, topic)
+	return nil
+}
+func (sb *stubBackend) Close() error { return nil }
+
+func newTestClient(ws *WsServer) *client {
+	return &client{
+		id:       generateRandomBytes16(),
+		ws:       ws,
+		protocol: V1,
+		sendbuf:  make(chan SocketMessage, 8),
+		quit:     make(chan struct{}),
+	}
+}
+
+// newTestConn serves a websocket connection with a client of `ws`, which is set up by `setup` before its
+// read and write loops start, the dialed peer connection is returned
+func newTestConn(t *testing.T, ws *WsServer, setup func(c *client)) *websocket.Conn {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := ws.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade error: %v", err)
+			return
+		}
+		c := newTestClient(ws)
+		c.conn = conn
+		c.closing = make(chan struct{})
+		c.closed = make(chan struct{})
+		if setup != nil {
+			setup(c)
+		}
+		go c.read()
+		go c.write()
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestPubMessageCachedWithoutSubscriber(t *testing.T) {
+	conf := config.LoadConfig("")
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+
+	dapp := newTestClient(ws)
+	dapp.role = Dapp
+	ws.legacyPubMessage(SocketMessage{Topic: "hello", Type: Pub, Payload: "world", Role: string(Dapp), client: dapp})
+
+	if len(backend.published) != 1 || len(backend.cached["hello"]) != 1 {
+		t.Errorf("message should be published and cached, published: %v, cached: %v", backend.published, backend.cached)
+	}
+	// no wallet received it, so there's no ack
+	if len(dapp.sendbuf) != 0 {
+		t.Errorf("length error, expected: %v, actual: %v", 0, len(dapp.sendbuf))
+	}
+
+	wallet := newTestClient(ws)
+	ws.subMessage(SocketMessage{Topic: "hello", Type: Sub, client: wallet})
+	if len(wallet.sendbuf) != 1 {
+		t.Fatalf("length error, expected: %v, actual: %v", 1, len(wallet.sendbuf))
+	}
+	if message := <-wallet.sendbuf; message.Payload != "world" {
+		t.Errorf("payload error, expected: %v, actual: %v", "world", message.Payload)
+	}
+	if len(backend.cached["hello"]) != 0 {
+		t.Errorf("cache should be drained, actual: %v", backend.cached["hello"])
+	}
+}
+
+func TestPubMessageNotCachedOnBrokerError(t *testing.T) {
+	conf := config.LoadConfig("")
+	backend := newStubBackend()
+	backend.err = errors.New("connection refused")
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+
+	dapp := newTestClient(ws)
+	dapp.role = Dapp
+	ws.legacyPubMessage(SocketMessage{Topic: "hello", Type: Pub, Payload: "world", Phase: string(SessionRequest), Role: string(Dapp), client: dapp})
+
+	if len(backend.cached["hello"]) != 0 {
+		t.Errorf("message should not be cached, actual: %v", backend.cached["hello"])
+	}
+	if len(ws.sessions.popExpired(time.Now().Add(time.Hour))) != 0 {
+		t.Errorf("session request should not be tracked")
+	}
+	// the dapp is told about both of the failures
+	for _, code := range []ErrorCode{ErrorSubscribe, ErrorPublish} {
+		if message := <-dapp.sendbuf; message.Type != Error || message.Code != code || message.Topic != "hello" {
+			t.Errorf("error message error, expected code: %v, actual: %+v", code, message)
+		}
+	}
+
+	message := SocketMessage{Topic: "hello", Type: IrnPublish, Payload: "world", client: dapp, call: &rpcCall{id: []byte("1")}}
+	ws.irnPublish(message)
+	reply := <-dapp.sendbuf
+	if reply.reply == nil || reply.reply.Error == nil || reply.reply.Error.Code != JsonRpcServerError {
+		t.Errorf("publish error should be replied, actual: %+v", reply.reply)
+	}
+}
+
+func TestResubscribeAfterBrokerRecovers(t *testing.T) {
+	conf := config.LoadConfig("")
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+
+	wallet := newTestClient(ws)
+	ws.updateTopics(SocketMessage{Topic: "wallet-topic", Type: Sub, client: wallet})
+	dapp := newTestClient(ws)
+	dapp.role = Dapp
+	ws.updateTopics(SocketMessage{Topic: "dapp-topic", Type: Pub, client: dapp})
+
+	backend.err = errors.New("connection refused")
+	ws.checkBroker(time.Second)
+	if ws.Ready() {
+		t.Errorf("relay should not be ready with the broker down")
+	}
+
+	backend.err = nil
+	ws.checkBroker(time.Second)
+	if !ws.Ready() {
+		t.Errorf("relay should be ready after the broker recovers")
+	}
+	expected := map[string]bool{messageChanKey("wallet-topic"): true, dappNotifyChanKey("dapp-topic"): true}
+	if len(backend.subscribed) != len(expected) {
+		t.Fatalf("length error, expected: %v, actual: %v", len(expected), len(backend.subscribed))
+	}
+	for _, channel := range backend.subscribed {
+		if !expected[channel] {
+			t.Errorf("unexpected channel resubscribed: %v", channel)
+		}
+	}
+
+	// no more resubscription while the broker keeps healthy
+	ws.checkBroker(time.Second)
+	if len(backend.subscribed) != len(expected) {
+		t.Errorf("length error, expected: %v, actual: %v", len(expected), len(backend.subscribed))
+	}
+}
+
+func TestHealth(t *testing.T) {
+	conf := config.LoadConfig("")
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+
+	// the main loop isn't running
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := ws.Health(ctx); err == nil {
+		t.Errorf("relay should not be healthy without the main loop running")
+	}
+
+	go ws.Run()
+	defer ws.Shutdown(context.Background())
+	if err := ws.Health(context.Background()); err != nil {
+		t.Errorf("relay should be healthy, actual: %v", err)
+	}
+
+	backend.err = errors.New("connection refused")
+	if err := ws.Health(context.Background()); err == nil {
+		t.Errorf("relay should not be healthy with the broker down")
+	}
+}
+
+func TestDeliveryAcks(t *testing.T) {
+	conf := config.LoadConfig("")
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+
+	dapp := newTestClient(ws)
+	dapp.role = Dapp
+	ws.legacyPubMessage(SocketMessage{Topic: "hello", Type: Pub, Payload: "world", Role: string(Dapp), client: dapp})
+	if len(backend.published) != 1 {
+		t.Fatalf("length error, expected: %v, actual: %v", 1, len(backend.published))
+	}
+	id := backend.published[0].ID
+	if id == "" {
+		t.Fatalf("message id should be assigned")
+	}
+
+	// the delivering node confirms the message is written to the wallet
+	ws.confirmDelivery(backend.published[0])
+	if ack := backend.published[1]; ack.Type != Ack || ack.Role != string(Relay) || ack.ID != id {
+		t.Errorf("delivery ack error, actual: %+v", ack)
+	}
+
+	// the wallet acks the message it has received
+	wallet := newTestClient(ws)
+	wallet.role = Wallet
+	ws.legacyAckMessage(SocketMessage{Topic: "hello", Type: Ack, ID: id, Role: string(Wallet), client: wallet})
+	if len(backend.published) != 2 {
+		t.Errorf("ack of unsubscribed topic should be ignored, published: %v", backend.published)
+	}
+	ws.subscribers.Set("hello", wallet)
+	ws.legacyAckMessage(SocketMessage{Topic: "hello", Type: Ack, ID: id, Role: string(Wallet), client: wallet})
+	if len(backend.published) != 3 {
+		t.Fatalf("length error, expected: %v, actual: %v", 3, len(backend.published))
+	}
+	if ack := backend.published[2]; ack.Type != Ack || ack.Role != string(Wallet) || ack.ID != id {
+		t.Errorf("wallet ack error, actual: %+v", ack)
+	}
+}
+
+// stubStream is an in process MessageStream, the entries are either unread, pending or acknowledged
+type stubStream struct {
+	sync.Mutex
+	entries map[string][]*stubStreamEntry
+	nextID  int
+}
+
+type stubStreamEntry struct {
+	message SocketMessage
+	read    bool
+	acked   bool
+}
+
+func newStubStream() *stubStream {
+	return &stubStream{entries: map[string][]*stubStreamEntry{}}
+}
+
+func (ss *stubStream) Add(ctx context.Context, topic string, message SocketMessage) error {
+	ss.Lock()
+	defer ss.Unlock()
+	ss.nextID++
+	message.streamID = fmt.Sprintf("%d-0", ss.nextID)
+	ss.entries[topic] = append(ss.entries[topic], &stubStreamEntry{message: message})
+	return nil
+}
+func (ss *stubStream) Read(ctx context.Context, topic string, pending bool) ([]SocketMessage, error) {
+	ss.Lock()
+	defer ss.Unlock()
+	messages := []SocketMessage{}
+	for _, entry := range ss.entries[topic] {
+		if entry.acked || entry.read != pending {
+			continue
+		}
+		entry.read = true
+		messages = append(messages, entry.message)
+	}
+	return messages, nil
+}
+func (ss *stubStream) Ack(ctx context.Context, topic string, ids ...string) error {
+	ss.Lock()
+	defer ss.Unlock()
+	for _, entry := range ss.entries[topic] {
+		for _, id := range ids {
+			if entry.message.streamID == id {
+				entry.acked = true
+			}
+		}
+	}
+	return nil
+}
+func (ss *stubStream) Delete(ctx context.Context, topic string) error {
+	ss.Lock()
+	defer ss.Unlock()
+	delete(ss.entries, topic)
+	return nil
+}
+
+func TestStreamRedeliversUnackedMessages(t *testing.T) {
+	conf := config.LoadConfig("")
+	backend := newStubBackend()
+	stream := newStubStream()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+	ws.stream = stream
+
+	dapp := newTestClient(ws)
+	dapp.role = Dapp
+	ws.legacyPubMessage(SocketMessage{Topic: "hello", Type: Pub, Payload: "world", Role: string(Dapp), client: dapp})
+	if len(backend.cached["hello"]) != 0 {
+		t.Errorf("message should be kept in the stream instead of the cache, cached: %v", backend.cached["hello"])
+	}
+
+	// the first connection receives the message but never writes it out
+	wallet := newTestClient(ws)
+	ws.subMessage(SocketMessage{Topic: "hello", Type: Sub, client: wallet})
+	if len(wallet.sendbuf) != 1 {
+		t.Fatalf("length error, expected: %v, actual: %v", 1, len(wallet.sendbuf))
+	}
+	<-wallet.sendbuf
+
+	// the next connection receives it again, and acknowledges it
+	wallet = newTestClient(ws)
+	ws.subMessage(SocketMessage{Topic: "hello", Type: Sub, client: wallet})
+	if len(wallet.sendbuf) != 1 {
+		t.Fatalf("length error, expected: %v, actual: %v", 1, len(wallet.sendbuf))
+	}
+	message := <-wallet.sendbuf
+	if message.Payload != "world" || message.streamID == "" {
+		t.Errorf("redelivered message error, actual: %+v", message)
+	}
+	ws.ackStream(message)
+
+	wallet = newTestClient(ws)
+	ws.subMessage(SocketMessage{Topic: "hello", Type: Sub, client: wallet})
+	if len(wallet.sendbuf) != 0 {
+		t.Errorf("length error, expected: %v, actual: %v", 0, len(wallet.sendbuf))
+	}
+}
+
+func TestReplayCachedMessages(t *testing.T) {
+	conf := config.LoadConfig("")
+	conf.WsServerConfig.ReplayCachedMessages = true
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+
+	dapp := newTestClient(ws)
+	ws.pubMessage(SocketMessage{Topic: "hello", Type: Pub, Payload: "world", client: dapp})
+
+	// every subscriber receives the cached message
+	for i := 0; i < 2; i++ {
+		wallet := newTestClient(ws)
+		ws.subMessage(SocketMessage{Topic: "hello", Type: Sub, client: wallet})
+		if len(wallet.sendbuf) != 1 {
+			t.Errorf("length error, expected: %v, actual: %v", 1, len(wallet.sendbuf))
+		}
+	}
+}
+
+func TestPublisherToldAboutCacheRejection(t *testing.T) {
+	conf := config.LoadConfig("")
+	backend := newStubBackend()
+	backend.cacheErr = errCacheQuotaExceeded
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+
+	dapp := newTestClient(ws)
+	dapp.role = Dapp
+	ws.legacyPubMessage(SocketMessage{Topic: "hello", Type: Pub, Payload: "world", Role: string(Dapp), client: dapp})
+	if len(dapp.sendbuf) != 1 {
+		t.Fatalf("length error, expected: %v, actual: %v", 1, len(dapp.sendbuf))
+	}
+	if message := <-dapp.sendbuf; message.Type != Error || message.Code != ErrorCacheFull {
+		t.Errorf("error message error, actual: %+v", message)
+	}
+
+	dapp.protocol = V2
+	ws.irnPublish(SocketMessage{Topic: "hello", Type: IrnPublish, Payload: "world", client: dapp, call: &rpcCall{id: []byte("1")}})
+	if reply := <-dapp.sendbuf; reply.reply == nil || reply.reply.Error == nil || reply.reply.Error.Message != errCacheQuotaExceeded.Error() {
+		t.Errorf("json-rpc error should be replied, actual: %+v", reply.reply)
+	}
+}
+
+func TestMessageTTL(t *testing.T) {
+	conf := config.LoadConfig("")
+	conf.WsServerConfig.MessageCacheTime = 1800
+	conf.WsServerConfig.MinMessageTTL = 10
+	conf.WsServerConfig.MaxMessageTTL = 3600
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+
+	cases := []struct {
+		ttl      int
+		expected time.Duration
+	}{
+		{0, 1800 * time.Second},
+		{1, 10 * time.Second},
+		{60, 60 * time.Second},
+		{86400, 3600 * time.Second},
+	}
+	for _, c := range cases {
+		if actual := ws.messageTTL(SocketMessage{TTL: c.ttl}); actual != c.expected {
+			t.Errorf("ttl error, ttl: %v, expected: %v, actual: %v", c.ttl, c.expected, actual)
+		}
+	}
+}
+
+func TestSubscribeFailureReported(t *testing.T) {
+	conf := config.LoadConfig("")
+	backend := newStubBackend()
+	backend.err = errors.New("connection refused")
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+
+	wallet := newTestClient(ws)
+	ws.legacySubMessage(SocketMessage{Topic: "hello", Type: Sub, client: wallet})
+	if message := <-wallet.sendbuf; message.Type != Error || message.Code != ErrorSubscribe || message.Topic != "hello" {
+		t.Errorf("subscribe error should be sent, actual: %+v", message)
+	}
+
+	ws.handleLocalMessage(SocketMessage{Topic: "hello", Type: "unknown", client: wallet})
+	if message := <-wallet.sendbuf; message.Type != Error || message.Code != ErrorUnsupported {
+		t.Errorf("unsupported error should be sent, actual: %+v", message)
+	}
+}
+
+func TestV1ConnectionCantSendRpcRequests(t *testing.T) {
+	conf := config.LoadConfig("")
+	conf.RelayServerConfig.Version = config.VersionAuto
+	conf.WsServerConfig.EventLoops = 1
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+	ws.loopsDone.Add(1)
+	go ws.runLoop(ws.loops[0])
+	t.Cleanup(func() { close(ws.quit) })
+
+	conn := newTestConn(t, ws, func(c *client) { c.protocol = "" })
+	for _, messageType := range []MessageType{IrnSubscribe, IrnBatchSubscribe, IrnPublish, IrnUnsubscribe} {
+		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"type":%q,"topic":"hello","payload":""}`, messageType)))
+		message := SocketMessage{}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		if message.Type != Error || message.Code != ErrorUnsupported {
+			t.Errorf("unsupported error should be sent for %v, actual: %+v", messageType, message)
+		}
+	}
+}
+
+func TestUnsubOnlyInLegacyMode(t *testing.T) {
+	conf := config.LoadConfig("")
+	conf.RelayServerConfig.Version = config.Version1
+	conf.RelayServerConfig.Mode = config.ModeStrict
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+	if _, ok := ws.handlers[V1][Unsub]; ok {
+		t.Errorf("unsub isn't in the official v1 spec")
+	}
+
+	conf.RelayServerConfig.Mode = config.ModeLegacy
+	ws = NewWSServerWithBackend(&conf, backend, backend)
+	if _, ok := ws.handlers[V1][Unsub]; !ok {
+		t.Errorf("unsub should be handled in the legacy mode")
+	}
+}
+
+func TestUnsubMessage(t *testing.T) {
+	conf := config.LoadConfig("")
+	broker := NewMemoryBroker()
+	ws := NewWSServerWithBackend(&conf, broker, NewMemoryMessageStore(&conf.CacheConfig))
+	ctx := context.TODO()
+
+	wallet := newTestClient(ws)
+	wallet.role = Wallet
+	ws.updateTopics(SocketMessage{Topic: "hello", Type: Sub, client: wallet})
+	broker.Subscribe(ctx, messageChanKey("hello"), dappNotifyChanKey("hello"))
+
+	// unsubscribing a topic not subscribed changes nothing
+	ws.updateTopics(SocketMessage{Topic: "world", Type: Unsub, client: wallet})
+	ws.updateTopics(SocketMessage{Topic: "hello", Type: Unsub, client: wallet})
+	if ws.subscribers.Len("hello") != 0 || len(ws.subscribers.GetTopicsByClient(wallet, false)) != 0 {
+		t.Errorf("subscription should be removed, subscribers: %v, topics: %v", ws.subscribers.Len("hello"), ws.subscribers.GetTopicsByClient(wallet, false))
+	}
+
+	// the dapp is told the wallet has left
+	select {
+	case m := <-broker.Messages():
+		if m.Channel != dappNotifyChanKey("hello") || !strings.Contains(m.Payload, string(SessionSuspended)) {
+			t.Errorf("notification error, channel: %v, payload: %v", m.Channel, m.Payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("dapp not notified")
+	}
+	select {
+	case m := <-broker.Messages():
+		t.Errorf("dapp should be notified once, actual: %v", m.Payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the message channel is unsubscribed as the last subscriber leaves
+	for i := 0; i < 100; i++ {
+		if count, _ := broker.Presence(ctx, messageChanKey("hello")); count == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("message channel should be unsubscribed")
+}
+
+func TestSweepExpiredSessionsQuits(t *testing.T) {
+	conf := config.LoadConfig("")
+	conf.WsServerConfig.CheckSessionExpireInterval = 1
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+
+	done := make(chan struct{})
+	go func() {
+		ws.sweepExpiredSessions()
+		close(done)
+	}()
+	close(ws.quit)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("sweeping should stop once the server quits")
+	}
+}
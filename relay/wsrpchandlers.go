@@ -0,0 +1,89 @@
+package relay
+
+import (
+	"context"
+	"time"
+
+	"github.com/RabbyHub/derelay/log"
+	"github.com/RabbyHub/derelay/metrics"
+	"go.uber.org/zap"
+)
+
+// isRpcCall checks the message is a json-rpc request, the irn_* handlers reply to its call
+func isRpcCall(message SocketMessage) bool {
+	if message.call == nil {
+		log.Warn("irn message without json-rpc call", zap.Any("client", message.client), zap.Any("message", message))
+		return false
+	}
+	return true
+}
+
+// irnPublish handles the v2 `irn_publish` request, the message is relayed in the same
+// way as a v1 "pub" message so that both kinds of clients share the broker channels and cache
+func (ws *WsServer) irnPublish(message SocketMessage) {
+	if !isRpcCall(message) {
+		return
+	}
+	publisher := message.client
+	call := message.call
+
+	message.Type = Pub
+	message.PublishedAt = time.Now().UnixMilli()
+
+	if _, err := ws.publishMessage(message); err != nil {
+		reason := "publish failed"
+		if isCacheRejection(err) {
+			reason = err.Error()
+		}
+		publisher.send(rpcReply(call, nil, &JsonRpcError{Code: JsonRpcServerError, Message: reason}))
+		return
+	}
+	publisher.send(rpcReply(call, true, nil))
+}
+
+// irnSubscribe handles both the `irn_subscribe` and `irn_batchSubscribe` requests
+func (ws *WsServer) irnSubscribe(message SocketMessage) {
+	if !isRpcCall(message) {
+		return
+	}
+	subscriber := message.client
+	call := message.call
+
+	channels := make([]string, 0, len(call.topics))
+	for _, topic := range call.topics {
+		channels = append(channels, messageChanKey(topic))
+	}
+	if err := ws.broker.Subscribe(context.TODO(), channels...); err != nil {
+		metrics.IncBrokerError("subscribe")
+		log.Warn("[broker] subscribe to topic fail", zap.Strings("topics", call.topics), zap.Any("client", subscriber), zap.Error(err))
+		subscriber.send(rpcReply(call, nil, &JsonRpcError{Code: JsonRpcServerError, Message: "subscribe failed"}))
+		return
+	}
+	log.Debug("subscribe to topic", zap.Strings("topics", call.topics), zap.Any("client", subscriber))
+
+	// reply before forwarding the cached messages, so the subscription id is known to the client
+	// by the time it receives them
+	ids := make([]string, 0, len(call.topics))
+	for _, topic := range call.topics {
+		ids = append(ids, subscriptionID(subscriber, topic))
+	}
+	if message.Type == IrnBatchSubscribe {
+		subscriber.send(rpcReply(call, ids, nil))
+	} else {
+		subscriber.send(rpcReply(call, ids[0], nil))
+	}
+
+	for _, topic := range call.topics {
+		ws.forwardCachedMessages(subscriber, topic)
+	}
+}
+
+// irnUnsubscribe handles the `irn_unsubscribe` request, the topic has already been
+// removed from the client's subscriptions in the wsserver main loop
+func (ws *WsServer) irnUnsubscribe(message SocketMessage) {
+	if !isRpcCall(message) {
+		return
+	}
+	log.Debug("unsubscribe from topic", zap.String("topic", message.Topic), zap.Any("client", message.client))
+	message.client.send(rpcReply(message.call, true, nil))
+}
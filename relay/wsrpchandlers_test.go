@@ -0,0 +1,78 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/RabbyHub/derelay/config"
+)
+
+func TestIrnSubscribe(t *testing.T) {
+	conf := config.LoadConfig("")
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+	backend.cached["hello"] = []SocketMessage{{Topic: "hello", Type: Pub, Payload: "world"}}
+
+	wallet := newTestClient(ws)
+	wallet.protocol = V2
+	ws.irnSubscribe(SocketMessage{Topic: "hello", Type: IrnSubscribe, client: wallet, call: &rpcCall{id: []byte("1"), topics: []string{"hello"}}})
+
+	// the subscription id is replied before the cached messages are forwarded
+	reply := <-wallet.sendbuf
+	if reply.reply == nil || reply.reply.Error != nil || string(reply.reply.ID) != "1" {
+		t.Fatalf("json-rpc result should be replied, actual: %+v", reply.reply)
+	}
+	if id, ok := reply.reply.Result.(string); !ok || id != subscriptionID(wallet, "hello") {
+		t.Errorf("subscription id error, expected: %v, actual: %v", subscriptionID(wallet, "hello"), reply.reply.Result)
+	}
+	if message := <-wallet.sendbuf; message.Topic != "hello" || message.Payload != "world" {
+		t.Errorf("cached message should be forwarded, actual: %+v", message)
+	}
+	if len(backend.subscribed) != 1 || backend.subscribed[0] != messageChanKey("hello") {
+		t.Errorf("subscribed channels error, actual: %v", backend.subscribed)
+	}
+}
+
+func TestIrnBatchSubscribe(t *testing.T) {
+	conf := config.LoadConfig("")
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+	backend.cached["world"] = []SocketMessage{{Topic: "world", Type: Pub, Payload: "cached"}}
+
+	wallet := newTestClient(ws)
+	wallet.protocol = V2
+	topics := []string{"hello", "world"}
+	ws.irnSubscribe(SocketMessage{Type: IrnBatchSubscribe, client: wallet, call: &rpcCall{id: []byte("2"), topics: topics}})
+
+	// the batch is replied with an array of the subscription ids in the order of the topics
+	reply := <-wallet.sendbuf
+	if reply.reply == nil || reply.reply.Error != nil {
+		t.Fatalf("json-rpc result should be replied, actual: %+v", reply.reply)
+	}
+	ids, ok := reply.reply.Result.([]string)
+	if !ok || len(ids) != len(topics) {
+		t.Fatalf("subscription ids error, actual: %v", reply.reply.Result)
+	}
+	for i, topic := range topics {
+		if ids[i] != subscriptionID(wallet, topic) {
+			t.Errorf("subscription id of %v error, expected: %v, actual: %v", topic, subscriptionID(wallet, topic), ids[i])
+		}
+	}
+	if message := <-wallet.sendbuf; message.Topic != "world" || message.Payload != "cached" {
+		t.Errorf("cached message should be forwarded, actual: %+v", message)
+	}
+}
+
+func TestIrnHandlersRequireCall(t *testing.T) {
+	conf := config.LoadConfig("")
+	backend := newStubBackend()
+	ws := NewWSServerWithBackend(&conf, backend, backend)
+
+	wallet := newTestClient(ws)
+	for _, handler := range []WsMessageHandler{(*WsServer).irnPublish, (*WsServer).irnSubscribe, (*WsServer).irnUnsubscribe} {
+		handler(ws, SocketMessage{Topic: "hello", Type: IrnSubscribe, client: wallet})
+	}
+	if len(wallet.sendbuf) != 0 || len(backend.published) != 0 || len(backend.subscribed) != 0 {
+		t.Errorf("message without json-rpc call should be ignored, sent: %v, published: %v, subscribed: %v",
+			len(wallet.sendbuf), backend.published, backend.subscribed)
+	}
+}
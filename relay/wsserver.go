@@ -3,7 +3,14 @@ package relay
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/RabbyHub/derelay/config"
 	"github.com/RabbyHub/derelay/log"
@@ -16,29 +23,133 @@ import (
 type WsServer struct {
 	config *config.WsConfig
 
+	// protocol behavior
+	protocol   ProtocolVersion // empty if the protocol is detected per connection
+	extensions bool            // whether the Rabby extensions are enabled
+	// the handlers of the message types, keyed by the protocol of the connections
+	handlers map[ProtocolVersion]map[MessageType]WsMessageHandler
+
 	// connection maintenance
 	clients    map[*client]struct{}
 	register   chan *client
 	unregister chan ClientUnregisterEvent
 
-	redisConn    *redis.Client
-	redisSubConn *redis.PubSub
+	broker        Broker
+	store         MessageStore
+	stream        MessageStream // nil unless the messages are delivered through streams
+	brokerHealthy atomic.Bool
+
+	// push notification, nil if disabled
+	webhookConfig *config.WebhookConfig
+	webhooks      WebhookStore
+	dispatcher    *webhookDispatcher
 
 	publishers  *TopicClientSet
 	subscribers *TopicClientSet
 
-	localCh chan SocketMessage // for handling message of local clients
+	// counts the subscribers of the topics across the relay nodes, nil if unlimited
+	subscriberStore SubscriberStore
+
+	// the messages are handled by the event loops sharded by topic, while the connections are
+	// registered and unregistered by the main loop
+	loops     []*eventLoop
+	loopsDone sync.WaitGroup
+	probes    chan chan struct{} // closed by the main loop to prove it's alive
+	handling  sync.WaitGroup     // the message handlers running
+
+	// no more local messages are dispatched once the loops start draining
+	dispatching sync.RWMutex
+	quitting    bool
+
+	sessions *pendingSessions
+
+	upgrader websocket.Upgrader
+	origins  *originChecker
+
+	// rate limits, nil if unlimited
+	trustedProxies []*net.IPNet
+	ipConnections  *keyedLimiter
+	ipMessages     *keyedLimiter
+
+	// graceful shutdown
+	draining atomic.Bool   // stop accepting new connections
+	quit     chan struct{} // closed to stop the main loop
+	stopped  chan struct{} // closed when the main loop has stopped
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // TODO Only white list allowed origins
-	},
+// NewWSServer creates the websocket server with the configured backend
+func NewWSServer(conf *config.Config) *WsServer {
+	delivery := conf.RelayServerConfig.Delivery
+	if delivery != config.DeliveryPubSub && delivery != config.DeliveryStream {
+		log.Fatal("unknown message delivery", fmt.Errorf("delivery: %v", delivery))
+	}
+	switch policy := conf.WsServerConfig.SlowConsumerPolicy; policy {
+	case config.SlowConsumerDrop, config.SlowConsumerCache, config.SlowConsumerDisconnect:
+	default:
+		log.Fatal("unknown slow consumer policy", fmt.Errorf("policy: %v", policy))
+	}
+	if size := conf.WsServerConfig.SendBufferSize; size <= 0 {
+		log.Fatal("invalid send buffer size", fmt.Errorf("send_buffer_size: %v", size))
+	}
+	switch format := conf.WsServerConfig.TopicFormat; format {
+	case config.TopicFormatAny, config.TopicFormatUUID, config.TopicFormatHex, config.TopicFormatWalletConnect:
+	default:
+		log.Fatal("unknown topic format", fmt.Errorf("format: %v", format))
+	}
+	switch policy := conf.CacheConfig.EvictionPolicy; policy {
+	case config.CacheEvictOldest, config.CacheRejectNewest:
+	default:
+		log.Fatal("unknown cache eviction policy", fmt.Errorf("policy: %v", policy))
+	}
+	if conf.WsServerConfig.MaxSubscribersPerTopic > 0 && conf.WsServerConfig.SubscriberTTL <= 0 {
+		log.Fatal("invalid subscriber ttl", fmt.Errorf("subscriber_ttl: %v", conf.WsServerConfig.SubscriberTTL))
+	}
+	if conf.WebhookConfig.Enable && len(conf.WebhookConfig.AllowedHosts) == 0 {
+		log.Fatal("webhook allowed hosts required", fmt.Errorf("allowed_hosts is empty"))
+	}
+
+	switch backend := conf.RelayServerConfig.Backend; backend {
+	case config.BackendRedis:
+		redisConn, err := newRedisClient(&conf.RedisServerConfig)
+		if err != nil {
+			log.Fatal("create redis client failed", err)
+		}
+		var broker Broker
+		if cluster, ok := redisConn.(*redis.ClusterClient); ok && conf.RedisServerConfig.ShardedPubSub {
+			broker = NewRedisShardedBroker(cluster)
+		} else {
+			broker = NewRedisBroker(redisConn)
+		}
+		ws := NewWSServerWithBackend(conf, broker, NewRedisMessageStore(redisConn, &conf.CacheConfig))
+		ws.setupWebhooks(NewRedisWebhookStore(redisConn))
+		ws.setupSubscriberLimit(NewRedisSubscriberStore(redisConn))
+		if delivery == config.DeliveryStream {
+			log.Info("using stream delivery, messages are delivered at least once")
+			// the undelivered messages are kept for `message_cache_time` at most, whatever their own ttl is
+			ws.stream = NewRedisMessageStream(redisConn, time.Duration(conf.WsServerConfig.MessageCacheTime)*time.Second)
+		}
+		return ws
+	case config.BackendMemory:
+		if delivery == config.DeliveryStream {
+			log.Fatal("stream delivery requires the redis backend", fmt.Errorf("backend: %v", backend))
+		}
+		log.Info("using in-memory backend, messages can't be shared with other relay nodes")
+		ws := NewWSServerWithBackend(conf, NewMemoryBroker(), NewMemoryMessageStore(&conf.CacheConfig))
+		ws.setupWebhooks(NewMemoryWebhookStore())
+		ws.setupSubscriberLimit(NewMemorySubscriberStore())
+		return ws
+	default:
+		log.Fatal("unknown relay backend", fmt.Errorf("backend: %v", backend))
+		return nil
+	}
 }
 
-func NewWSServer(config *config.Config) *WsServer {
+// NewWSServerWithBackend creates the websocket server relaying messages through the broker
+// and caching them in the store
+func NewWSServerWithBackend(config *config.Config, broker Broker, store MessageStore) *WsServer {
 	ws := &WsServer{
-		config: &config.WsServerConfig, // config
+		config:        &config.WsServerConfig, // config
+		webhookConfig: &config.WebhookConfig,
 
 		clients:    make(map[*client]struct{}),
 		register:   make(chan *client, 4096),
@@ -47,33 +158,139 @@ func NewWSServer(config *config.Config) *WsServer {
 		publishers:  NewTopicClientSet(),
 		subscribers: NewTopicClientSet(),
 
-		localCh: make(chan SocketMessage, 2),
+		probes: make(chan chan struct{}),
+
+		sessions: newPendingSessions(),
+
+		quit:    make(chan struct{}),
+		stopped: make(chan struct{}),
+
+		handlers: map[ProtocolVersion]map[MessageType]WsMessageHandler{},
+
+		broker: broker,
+		store:  store,
+	}
+
+	loops := config.WsServerConfig.EventLoops
+	if loops <= 0 {
+		loops = runtime.NumCPU()
+	}
+	for i := 0; i < loops; i++ {
+		ws.loops = append(ws.loops, newEventLoop())
+	}
+
+	ws.brokerHealthy.Store(true)
+	metrics.SetBrokerUp(true)
+
+	ws.setupProtocol(&config.RelayServerConfig)
+
+	ws.origins = newOriginChecker(config.WsServerConfig.AllowedOrigins, config.WsServerConfig.AllowEmptyOrigin)
+	ws.trustedProxies = parseTrustedProxies(config.WsServerConfig.TrustedProxies)
+	ws.ipConnections = newKeyedLimiter(config.WsServerConfig.ConnectionRate, config.WsServerConfig.ConnectionBurst)
+	ws.ipMessages = newKeyedLimiter(config.WsServerConfig.IPMessageRate, config.WsServerConfig.IPMessageBurst)
+	ws.upgrader = websocket.Upgrader{
+		CheckOrigin: ws.checkOrigin,
 	}
-	ws.redisConn = redis.NewClient(&redis.Options{
-		Addr:     config.RedisServerConfig.ServerAddr,
-		Password: config.RedisServerConfig.Password,
-		DB:       0,
-	})
-	ws.redisSubConn = ws.redisConn.Subscribe(context.TODO())
 
 	return ws
 }
 
+// setupWebhooks enables the push notification webhooks if configured
+func (ws *WsServer) setupWebhooks(store WebhookStore) {
+	if !ws.webhookConfig.Enable {
+		return
+	}
+	ws.webhooks = store
+	ws.dispatcher = newWebhookDispatcher(ws.webhookConfig)
+}
+
+// setupSubscriberLimit enables the limit of the subscribers per topic if configured
+func (ws *WsServer) setupSubscriberLimit(store SubscriberStore) {
+	if ws.config.MaxSubscribersPerTopic <= 0 {
+		return
+	}
+	ws.subscriberStore = store
+}
+
+// handler returns the handler of the message, a message type is only handled if it belongs to
+// the protocol of the connection, e.g. a v1 connection can't send the irn_* requests
+func (ws *WsServer) handler(message SocketMessage) (WsMessageHandler, bool) {
+	handler, ok := ws.handlers[message.client.protocol][message.Type]
+	return handler, ok
+}
+
+// setupProtocol wires the message handlers according to the configured protocol version and mode
+func (ws *WsServer) setupProtocol(relayConfig *config.RelayConfig) {
+	v1 := v1Handlers
+	switch relayConfig.Mode {
+	case config.ModeLegacy:
+		v1 = legacyHandlers
+		ws.extensions = true
+	case config.ModeStrict:
+	default:
+		log.Fatal("unknown relay mode", fmt.Errorf("mode: %v", relayConfig.Mode))
+	}
+
+	switch relayConfig.Version {
+	case config.Version1:
+		ws.protocol = V1
+		ws.handlers[V1] = v1
+	case config.Version2:
+		ws.protocol = V2
+		ws.handlers[V2] = v2Handlers
+	case config.VersionAuto:
+		ws.handlers[V1] = v1
+		ws.handlers[V2] = v2Handlers
+	default:
+		log.Fatal("unknown relay protocol version", fmt.Errorf("version: %v", relayConfig.Version))
+	}
+	log.Info("relay protocol", zap.String("version", relayConfig.Version), zap.String("mode", relayConfig.Mode))
+}
+
+// checkOrigin only allows the origins white listed in `WsConfig.AllowedOrigins`
+func (ws *WsServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if ws.origins.check(origin) {
+		return true
+	}
+
+	metrics.IncRejectedConnection("origin")
+	log.Warn("origin not allowed, reject websocket upgrade", zap.String("origin", origin), zap.String("remote", r.RemoteAddr))
+	return false
+}
+
 func (ws *WsServer) NewClientConn(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	if ws.draining.Load() {
+		http.Error(w, "relay is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	ip := clientIP(r, ws.trustedProxies)
+	if !ws.ipConnections.allow(ip, time.Now()) {
+		metrics.IncRateLimited("connection")
+		metrics.IncRejectedConnection("rate_limit")
+		log.Warn("too many connections, reject websocket upgrade", zap.String("ip", ip))
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+
+	conn, err := ws.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		// ignore the clients who ain't mean to do websocket communication with us
 		return
 	}
 
 	client := &client{
-		conn:      conn,
-		id:        generateRandomBytes16(),
-		ws:        ws,
-		pubTopics: NewTopicSet(),
-		subTopics: NewTopicSet(),
-		sendbuf:   make(chan SocketMessage, 8),
-		quit:      make(chan struct{}),
+		conn:     conn,
+		id:       generateRandomBytes16(),
+		ip:       ip,
+		ws:       ws,
+		protocol: ws.protocol,
+		limiter:  newTokenBucket(ws.config.MessageRate, ws.config.MessageBurst),
+		sendbuf:  make(chan SocketMessage, ws.config.SendBufferSize),
+		quit:     make(chan struct{}),
+		closing:  make(chan struct{}),
+		closed:   make(chan struct{}),
 	}
 
 	ws.register <- client
@@ -83,76 +300,115 @@ func (ws *WsServer) NewClientConn(w http.ResponseWriter, r *http.Request) {
 }
 
 func (ws *WsServer) Run() {
-	log.Info("Websocket server has been started")
+	log.Info("Websocket server has been started", zap.Int("loops", len(ws.loops)))
+
+	go ws.sweepExpiredSessions()
+	go ws.watchBroker()
+	go ws.refreshSubscribers()
 
-	remoteCh := ws.redisSubConn.Channel()
+	ws.loopsDone.Add(len(ws.loops) + 1)
+	for _, loop := range ws.loops {
+		go ws.runLoop(loop)
+	}
+	go ws.routeRemote(ws.broker.Messages())
 
 	for {
 		select {
-		case message := <-ws.localCh:
-			// local message could be "pub", "sub" or "ack" or "ping"
-			// pub/sub message handler may contain time-consuming operations(e.g. read/write redis)
-			// so put them in separate goroutine to avoid blocking wsserver main loop
-			switch message.Type {
-			case Pub:
-				// do not modify wsserver's local variable in seperate goroutine
-				message.client.pubTopics.Set(message.Topic)
-				ws.publishers.Set(message.Topic, message.client)
-				go ws.pubMessage(message)
-				log.Info("local message", zap.Any("client", message.client), zap.Any("message", message))
-			case Sub:
-				message.client.subTopics.Set(message.Topic)
-				ws.subscribers.Set(message.Topic, message.client)
-				go ws.subMessage(message)
-				log.Info("local message", zap.Any("client", message.client), zap.Any("message", message))
-			case Ping:
-				ws.handlePingMessage(message)
-			}
-		case chmessage := <-remoteCh:
-
-			message := SocketMessage{}
-			err := json.Unmarshal([]byte(chmessage.Payload), &message)
-			if err != nil {
-				log.Warn("malformed message from remote", zap.String("payload", chmessage.Payload))
-				continue
-			}
-			log.Info("remote message", zap.Any("message", message))
-
-			// if message is not from `dappNotifyChan`, then must be from `messageChan` and must be a "pub" message
-			if !fromDappNotifyChan(chmessage.Channel) {
-				for _, subscriber := range ws.GetSubscriber(message.Topic) {
-					log.Info("forward to subscriber", zap.Any("client", subscriber), zap.Any("message", message))
-					subscriber.send(message)
-				}
-				continue
-			}
-
-			// otherwise the message must be from the `dappNofityChan` channel
-			// messages from chanNotifyDapp could be:
-			//  * SessionReceived
-			//	* SessionSuspended
-			//	* SessionResumed
-			// 	* relay generated fake "ack" for the wallet
-			for _, publisher := range ws.GetDappPublisher(message.Topic) {
-				log.Debug("wallet updates, notify dapp", zap.Any("client", publisher), zap.Any("message", message))
-				publisher.send(message)
-			}
+		case probe := <-ws.probes:
+			close(probe)
 
 		case client := <-ws.register:
 			metrics.IncNewConnection()
 			ws.clients[client] = struct{}{}
 			metrics.SetCurrentConnections(len(ws.clients))
 
+		case <-ws.quit:
+			ws.drain()
+			close(ws.stopped)
+			return
+
 		case unregisterEvent := <-ws.unregister:
-			client, reason := unregisterEvent.client, unregisterEvent.reason
+			ws.unregisterClient(unregisterEvent)
+		}
+	}
+}
+
+// updateTopics maintains the topic-client relationships changed by the message,
+// returns false if the client has gone, so the message needn't be handled
+func (ws *WsServer) updateTopics(message SocketMessage) bool {
+	client := message.client
+
+	switch message.Type {
+	case Pub:
+		ws.publishers.Set(message.Topic, client)
+	case Sub, IrnSubscribe, IrnBatchSubscribe:
+		for _, topic := range message.topics() {
+			ws.subscribers.Set(topic, client)
+		}
+	case Unsub, IrnUnsubscribe:
+		if !ws.subscribers.Has(message.Topic, client) {
+			return true
+		}
+		if ws.subscribers.Remove(message.Topic, client) {
+			go ws.unsubscribeChannels(messageChanKey(message.Topic))
+		}
+		ws.notifyWalletSuspended(client, message.Topic)
+		return true
+	default:
+		return true
+	}
 
-			ws.handleClientDisconnect(client)
-			delete(ws.clients, client)
+	// the main loop may have cleared the topics of the disconnected client while the message was queued,
+	// clear them again, or the dead client would be kept in the topics forever.
+	// NOTE `gone` is set before the topics are cleared, so either the main loop sees the topics set above,
+	// or we see `gone` here
+	if client.gone.Load() {
+		ws.handleClientDisconnect(client)
+		return false
+	}
+	return true
+}
 
-			metrics.IncClosedConnection()
-			metrics.SetCurrentConnections(len(ws.clients))
-			log.Info("client disconnected", zap.Any("client", client), zap.String("reason", reason.Error()))
+// handleRemoteMessage forwards the message received from the broker channels to the local clients
+func (ws *WsServer) handleRemoteMessage(chmessage *BrokerMessage) {
+	message := SocketMessage{}
+	err := json.Unmarshal([]byte(chmessage.Payload), &message)
+	if err != nil {
+		log.Warn("malformed message from remote", zap.String("payload", chmessage.Payload))
+		return
+	}
+	log.Info("remote message", zap.Any("message", message))
+
+	// if message is not from `dappNotifyChan`, then must be from `messageChan` and must be a "pub" message
+	// with stream delivery, the message just tells there're new entries in the stream
+	if !fromDappNotifyChan(chmessage.Channel) && ws.stream != nil {
+		go ws.forwardStreamMessages(message.Topic)
+		return
+	}
+	if !fromDappNotifyChan(chmessage.Channel) {
+		message.recache = true
+		for _, subscriber := range ws.GetSubscriber(message.Topic) {
+			log.Info("forward to subscriber", zap.Any("client", subscriber), zap.Any("message", message))
+			subscriber.send(message)
 		}
+		return
+	}
+
+	// otherwise the message must be from the `dappNofityChan` channel
+	// messages from chanNotifyDapp could be:
+	//  * SessionReceived
+	//	* SessionSuspended
+	//	* SessionResumed
+	//	* SessionExpired
+	// 	* relay generated fake "ack" for the wallet
+	//
+	// a received session is no longer pending, stop tracking its expiry
+	if message.Phase == string(SessionReceived) {
+		ws.sessions.remove(message.Topic)
+	}
+	for _, publisher := range ws.GetDappPublisher(message.Topic) {
+		log.Debug("wallet updates, notify dapp", zap.Any("client", publisher), zap.Any("message", message))
+		publisher.send(message)
 	}
 }
 
@@ -176,37 +432,293 @@ func (ws *WsServer) GetDappPublisher(topic string) []*client {
 	return dapps
 }
 
-// getCachedMessages gets pending notifications from cache by topic
-// you can set `clear` to true if you want clear the pending notifications meanwhile
-func (ws *WsServer) getCachedMessages(topic string, clear bool) []SocketMessage {
-	// Retrieve the notifications from Redis by topic
-	notificationBytes, err := ws.redisConn.LRange(context.TODO(), cachedMessageKey(topic), 0, -1).Result()
+// channels returns the broker channels the relay node should be subscribing, it's derived from
+// the local subscribers and publishers so it's always authoritative
+func (ws *WsServer) channels() []string {
+	channels := []string{}
+	for _, topic := range ws.subscribers.Topics() {
+		if ws.subscribers.Len(topic) > 0 {
+			channels = append(channels, messageChanKey(topic))
+		}
+	}
+	for _, topic := range ws.publishers.Topics() {
+		if len(ws.GetDappPublisher(topic)) > 0 {
+			channels = append(channels, dappNotifyChanKey(topic))
+		}
+	}
+	return channels
+}
+
+// wantsChannel checks whether the broker channel is still needed by any local client
+func (ws *WsServer) wantsChannel(channel string) bool {
+	topic := channelTopic(channel)
+	if fromDappNotifyChan(channel) {
+		return len(ws.GetDappPublisher(topic)) > 0
+	}
+	return ws.subscribers.Len(topic) > 0
+}
+
+// unsubscribeChannels unsubscribes the broker channels no local client needs anymore,
+// the channels wanted again by the time it runs(e.g. the topic is resubscribed) are kept
+func (ws *WsServer) unsubscribeChannels(channels ...string) {
+	unwanted := []string{}
+	for _, channel := range channels {
+		if !ws.wantsChannel(channel) {
+			unwanted = append(unwanted, channel)
+		}
+	}
+
+	// !!! WARNING !!!
+	// Only call `Unsubscribe` when the length of `unwanted` IS NOT 0.
+	// Otherwise the broker will unsubscribe all of the previous subscribed channels!!!
+	if len(unwanted) == 0 {
+		return
+	}
+	if err := ws.broker.Unsubscribe(context.TODO(), unwanted...); err != nil {
+		metrics.IncBrokerError("unsubscribe")
+		log.Warn("[broker] unsubscribe channels fail", zap.Strings("channels", unwanted), zap.Error(err))
+	}
+}
+
+// watchBroker periodically checks the broker connectivity, and subscribes all of the wanted channels
+// again after the broker recovers, in case the subscriptions were lost(e.g. redis restarted)
+func (ws *WsServer) watchBroker() {
+	interval := time.Duration(ws.config.BrokerCheckInterval) * time.Second
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ws.checkBroker(interval)
+		case <-ws.quit:
+			return
+		}
+	}
+}
+
+// checkBroker pings the broker and updates its health status
+func (ws *WsServer) checkBroker(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := ws.broker.Ping(ctx); err != nil {
+		if ws.brokerHealthy.Swap(false) {
+			log.Warn("[broker] broker is down", zap.Error(err))
+		}
+		metrics.SetBrokerUp(false)
+		metrics.IncBrokerError("ping")
+		return
+	}
+
+	metrics.SetBrokerUp(true)
+	if ws.brokerHealthy.Load() {
+		return
+	}
+
+	channels := ws.channels()
+	log.Info("[broker] broker recovers, resubscribe channels", zap.Int("num", len(channels)))
+	if len(channels) > 0 {
+		if err := ws.broker.Subscribe(ctx, channels...); err != nil {
+			// stay unhealthy so that it's retried on next check
+			metrics.IncBrokerError("subscribe")
+			log.Warn("[broker] resubscribe channels fail", zap.Error(err))
+			return
+		}
+	}
+	metrics.IncBrokerResubscription()
+	ws.brokerHealthy.Store(true)
+}
+
+// Ready reports whether the relay node is able to relay messages
+func (ws *WsServer) Ready() bool {
+	return !ws.draining.Load() && ws.brokerHealthy.Load()
+}
+
+// Health checks the broker right away and whether the main loop and event loops still handle events, unlike `Ready`
+// it doesn't rely on the result of the last periodical broker check
+func (ws *WsServer) Health(ctx context.Context) error {
+	if ws.draining.Load() {
+		return errors.New("relay is shutting down")
+	}
+	if err := ws.broker.Ping(ctx); err != nil {
+		return fmt.Errorf("broker is unreachable: %w", err)
+	}
+
+	if err := probe(ctx, ws.probes); err != nil {
+		return fmt.Errorf("main loop: %w", err)
+	}
+	for i, loop := range ws.loops {
+		if err := probe(ctx, loop.probes); err != nil {
+			return fmt.Errorf("loop %v: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// getCachedMessages gets and clears pending notifications from cache by topic, with stream delivery
+// they're the messages not acknowledged yet, both the ones delivered before and the new ones
+func (ws *WsServer) getCachedMessages(topic string) []SocketMessage {
+	if ws.stream != nil {
+		return ws.readStream(topic, true)
+	}
+
+	// replay the messages to every subscriber until they expire
+	if ws.config.ReplayCachedMessages {
+		notifications, err := ws.store.Range(context.TODO(), topic)
+		if err != nil {
+			log.Warn("get cached messages failed", zap.String("topic", topic), zap.Error(err))
+			return nil
+		}
+		return notifications
+	}
+
+	notifications, err := ws.store.Drain(context.TODO(), topic)
 	if err != nil {
 		log.Warn("get cached messages failed", zap.String("topic", topic), zap.Error(err))
 		return nil
 	}
 
-	// Deserialize the notifications from JSON
-	notifications := make([]SocketMessage, 0, len(notificationBytes))
-	for _, nb := range notificationBytes {
-		var n SocketMessage
-		err := json.Unmarshal([]byte(nb), &n)
+	if len(notifications) > 0 {
+		metrics.DecCachedMessages()
+	}
+	return notifications
+}
+
+// readStream reads the messages of the topic from the stream, including the pending ones if `pending` is set
+func (ws *WsServer) readStream(topic string, pending bool) []SocketMessage {
+	messages := []SocketMessage{}
+	if pending {
+		redelivered, err := ws.stream.Read(context.TODO(), topic, true)
 		if err != nil {
-			log.Error("malformed message, unmarshal failed", nil, zap.Any("topic", topic), zap.Any("notification", nb))
-			return nil
+			metrics.IncBrokerError("stream")
+			log.Warn("[stream] read pending messages fail", zap.String("topic", topic), zap.Error(err))
 		}
-		notifications = append(notifications, n)
+		messages = append(messages, redelivered...)
+	}
+
+	unread, err := ws.stream.Read(context.TODO(), topic, false)
+	if err != nil {
+		metrics.IncBrokerError("stream")
+		log.Warn("[stream] read messages fail", zap.String("topic", topic), zap.Error(err))
 	}
+	messages = append(messages, unread...)
 
-	if clear && len(notifications) > 0 {
-		go func() {
-			metrics.DecCachedMessages()
-			ws.redisConn.Del(context.TODO(), cachedMessageKey(topic))
-		}()
+	if len(messages) > 0 {
+		metrics.DecCachedMessages()
 	}
+	return messages
+}
 
-	return notifications
+// forwardStreamMessages forwards the new messages of the topic in the stream to the local subscribers,
+// the messages are acknowledged once they have been written to the subscribers
+func (ws *WsServer) forwardStreamMessages(topic string) {
+	for _, message := range ws.readStream(topic, false) {
+		for _, subscriber := range ws.GetSubscriber(topic) {
+			log.Info("forward to subscriber", zap.Any("client", subscriber), zap.Any("message", message))
+			subscriber.send(message)
+		}
+	}
 }
 
-func (ws *WsServer) Shutdown() {
+// ackStream acknowledges the message read from the stream has been delivered
+func (ws *WsServer) ackStream(message SocketMessage) {
+	if err := ws.stream.Ack(context.TODO(), message.Topic, message.streamID); err != nil {
+		metrics.IncBrokerError("stream")
+		log.Warn("[stream] ack message fail", zap.String("topic", message.Topic), zap.String("id", message.streamID), zap.Error(err))
+	}
+}
+
+// unregisterClient clears the terminated client
+func (ws *WsServer) unregisterClient(event ClientUnregisterEvent) {
+	client, reason := event.client, event.reason
+
+	ws.handleClientDisconnect(client)
+	delete(ws.clients, client)
+
+	metrics.IncClosedConnection()
+	metrics.SetCurrentConnections(len(ws.clients))
+	log.Info("client disconnected", zap.Any("client", client), zap.String("reason", reason.Error()))
+}
+
+// drain waits for the event loops to forward the remote messages already received, then asks every client
+// to flush its pending messages and close the connection, it should be called in the main loop
+func (ws *WsServer) drain() {
+	ws.loopsDone.Wait()
+DRAIN:
+	for {
+		select {
+		case client := <-ws.register:
+			ws.clients[client] = struct{}{}
+		// the clients already terminated won't be closed again
+		case unregisterEvent := <-ws.unregister:
+			ws.unregisterClient(unregisterEvent)
+		default:
+			break DRAIN
+		}
+	}
+
+	log.Info("closing clients", zap.Int("num", len(ws.clients)))
+	for client := range ws.clients {
+		client.close(websocket.CloseGoingAway, "relay shutting down")
+	}
+}
+
+// Shutdown stops accepting new connections, closes the existing ones after flushing their pending messages,
+// the messages that can't be delivered are cached so that they can be received after the clients reconnect
+func (ws *WsServer) Shutdown(ctx context.Context) {
+	ws.draining.Store(true)
+
+	// stop receiving messages from other relay nodes, the messages for our clients will be cached from now on
+	// NOTE calling `Unsubscribe` without channels unsubscribes all of the channels
+	if err := ws.broker.Unsubscribe(ctx); err != nil {
+		log.Warn("[broker] unsubscribe all channels fail", zap.Error(err))
+	}
+
+	ws.dispatching.Lock()
+	ws.quitting = true
+	ws.dispatching.Unlock()
+	close(ws.quit)
+	select {
+	case <-ws.stopped:
+	case <-ctx.Done():
+		log.Warn("wsserver main loop doesn't stop in time", zap.Error(ctx.Err()))
+		return
+	}
+
+	// the main loop has stopped, it's safe to access the clients
+	for client := range ws.clients {
+		select {
+		case <-client.closed:
+		case <-ctx.Done():
+			log.Warn("clients aren't closed in time", zap.Error(ctx.Err()))
+			return
+		}
+	}
+
+	// the handlers may still be publishing or caching the messages
+	handled := make(chan struct{})
+	go func() {
+		ws.handling.Wait()
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-ctx.Done():
+		log.Warn("message handlers don't finish in time", zap.Error(ctx.Err()))
+		return
+	}
+
+	// let the subscribers reconnect to other relay nodes without waiting for their slots to expire
+	ws.leaveAllTopics(ctx)
+
+	if ws.dispatcher != nil {
+		ws.dispatcher.close()
+	}
+	ws.broker.Close()
+	ws.store.Close()
+	log.Info("Websocket server has been shutdown")
 }